@@ -0,0 +1,204 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/tgulacsi/webdlna/dlna"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthConfig is the configuration of the authentication; none is required if there are no users and tokens.
+type AuthConfig struct {
+	Realm string `json:"realm,omitempty"`
+	// Users maps the user names to bcrypt password hashes (htpasswd -B).
+	Users map[string]string `json:"users,omitempty"`
+	// Htpasswd is a file of user:bcrypt-hash lines, read besides Users.
+	Htpasswd string `json:"htpasswd,omitempty"`
+	// Tokens maps the bearer tokens to user names.
+	Tokens map[string]string `json:"tokens,omitempty"`
+	// Allow maps the user names to the globs of the container IDs and titles they may see
+	// (a folder is visible if its ID, its parent's ID or its title matches).
+	// Users not listed here see everything.
+	Allow map[string][]string `json:"allow,omitempty"`
+	// DLNAUser is the user whose allowed folders the DLNA MediaServer lists, as its clients can't authenticate;
+	// its media URLs are signed per item. Needed for the DLNA feature with authentication.
+	DLNAUser string `json:"dlnaUser,omitempty"`
+}
+
+// compile returns the authenticator of the configuration, nil if no authentication is required.
+func (c AuthConfig) compile() (*authenticator, error) {
+	users := make(map[string]string, len(c.Users))
+	for user, hash := range c.Users {
+		users[user] = hash
+	}
+	if c.Htpasswd != "" {
+		b, err := os.ReadFile(c.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, hash, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("%s: bad line %q", c.Htpasswd, line)
+			}
+			users[user] = hash
+		}
+	}
+	if len(users) == 0 && len(c.Tokens) == 0 {
+		return nil, nil
+	}
+	for user, hash := range users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("password hash of %q (only bcrypt is supported): %w", user, err)
+		}
+	}
+	a := authenticator{realm: c.Realm, users: users, tokens: c.Tokens, dlnaUser: c.DLNAUser}
+	if a.realm == "" {
+		a.realm = "webdlna"
+	}
+	if len(c.Allow) != 0 {
+		a.allow = make(map[string][]*regexp.Regexp, len(c.Allow))
+		for user, globs := range c.Allow {
+			res := make([]*regexp.Regexp, 0, len(globs))
+			for _, g := range globs {
+				re, err := regexp.Compile(`^(?:` + globRegexp(g) + `)$`)
+				if err != nil {
+					return nil, fmt.Errorf("allow %q for %q: %w", g, user, err)
+				}
+				res = append(res, re)
+			}
+			a.allow[user] = res
+		}
+	}
+	return &a, nil
+}
+
+// authenticator checks the HTTP Basic authentication against bcrypt password hashes,
+// and the bearer tokens; and restricts the users to their allowed folders.
+type authenticator struct {
+	realm    string
+	users    map[string]string
+	tokens   map[string]string
+	allow    map[string][]*regexp.Regexp
+	dlnaUser string
+
+	// verified caches the successful checks, as bcrypt is slow on purpose.
+	verified sync.Map
+}
+
+// Authenticate returns the user of the request's credentials: a bearer token or Basic authentication.
+func (a *authenticator) Authenticate(r *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return a.tokenUser(token)
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, ok := a.users[user]
+	if !ok {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(user + "\x00" + pass))
+	if v, ok := a.verified.Load(user); ok && subtle.ConstantTimeCompare(v.([]byte), sum[:]) == 1 {
+		return user, true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return "", false
+	}
+	a.verified.Store(user, sum[:])
+	return user, true
+}
+
+func (a *authenticator) tokenUser(token string) (string, bool) {
+	for t, user := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// Challenge asks for credentials.
+func (a *authenticator) Challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+a.realm+`", charset="UTF-8"`)
+	w.Header().Add("WWW-Authenticate", `Bearer realm="`+a.realm+`"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// DLNAUser returns the user of the DLNA MediaServer's clients.
+func (a *authenticator) DLNAUser() string { return a.dlnaUser }
+
+// Allowed reports whether the user may see the folder.
+// Everybody may see everything without authentication, and so may the users without an allow list.
+func (a *authenticator) Allowed(user string, c dlna.Container) bool {
+	if a == nil {
+		return true
+	}
+	res, ok := a.allow[user]
+	if !ok {
+		return true
+	}
+	for _, re := range res {
+		if re.MatchString(c.ID) || re.MatchString(c.ParentID) || re.MatchString(c.Title) {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted reports whether the user has an allow list.
+func (a *authenticator) Restricted(user string) bool {
+	return a != nil && a.allow[user] != nil
+}
+
+// Visible returns the folders the user may see.
+func (a *authenticator) Visible(user string, data []Folder) []Folder {
+	if !a.Restricted(user) {
+		return data
+	}
+	visible := make([]Folder, 0, len(data))
+	for _, f := range data {
+		if a.Allowed(user, f.Container) {
+			visible = append(visible, f)
+		}
+	}
+	return visible
+}
+
+type userKey struct{}
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// userOf returns the authenticated user of the context, "" if there's none (unrestricted).
+func userOf(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// owner returns the user whose shares and queues the request may manage, "" for all of them.
+func (h *handler) owner(r *http.Request) string {
+	if user := userOf(r.Context()); h.conf().auth.Restricted(user) {
+		return user
+	}
+	return ""
+}
@@ -0,0 +1,210 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// negotiateEncoding returns the preferred encoding of the Accept-Encoding header: "br", "gzip" or "" (identity).
+func negotiateEncoding(accept string) string {
+	var best string
+	var bestQ float64
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "br" && coding != "gzip" || q <= 0 {
+			continue
+		}
+		// brotli wins a tie, as it compresses better.
+		if q > bestQ || (q == bestQ && coding == "br") {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether the response of the content type is worth compressing.
+func compressible(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return mt == "text/html" || mt == "application/json" || mt == "text/plain"
+}
+
+var (
+	gzipWriters   = sync.Pool{New: func() any { w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression); return w }}
+	brotliWriters = sync.Pool{New: func() any { return brotli.NewWriterLevel(nil, 4) }}
+)
+
+// compressWriter compresses the response with the encoding, if its content type is compressible
+// and it's not encoded already (e.g. a precompressed snapshot).
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	decided bool
+	w       io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.decided = true
+		h := w.Header()
+		if code != http.StatusNoContent && code != http.StatusNotModified &&
+			h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+			h.Set("Content-Encoding", w.encoding)
+			h.Add("Vary", "Accept-Encoding")
+			h.Del("Content-Length")
+			switch w.encoding {
+			case "br":
+				bw := brotliWriters.Get().(*brotli.Writer)
+				bw.Reset(w.ResponseWriter)
+				w.w = bw
+			case "gzip":
+				gw := gzipWriters.Get().(*gzip.Writer)
+				gw.Reset(w.ResponseWriter)
+				w.w = gw
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.w != nil {
+		return w.w.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Close flushes the compressed stream.
+func (w *compressWriter) Close() error {
+	if w.w == nil {
+		return nil
+	}
+	err := w.w.Close()
+	switch x := w.w.(type) {
+	case *brotli.Writer:
+		brotliWriters.Put(x)
+	case *gzip.Writer:
+		gzipWriters.Put(x)
+	}
+	w.w = nil
+	return err
+}
+
+// Flush sends the data written so far to the client, flushing the compressor first.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return
+		}
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// compress returns the data compressed with the encoding, at the best (slow) level, for caching.
+func compress(data []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "br":
+		w = brotli.NewWriterLevel(&buf, 9)
+	case "gzip":
+		w, _ = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	default:
+		return data, nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// snapshots caches the renders of the full library page by key, in every encoding;
+// dropped when the library is refreshed.
+type snapshots struct {
+	mu       sync.Mutex
+	fillTime time.Time
+	byKey    map[string][]byte
+}
+
+// Get returns the render of the snapshot of fillTime with the key in the encoding,
+// rendering and compressing it if it's not cached yet.
+func (sc *snapshots) Get(fillTime time.Time, key, encoding string, render func() ([]byte, error)) ([]byte, error) {
+	plainKey, encKey := key+"\x00", key+"\x00"+encoding
+	sc.mu.Lock()
+	if !sc.fillTime.Equal(fillTime) {
+		sc.fillTime, sc.byKey = fillTime, make(map[string][]byte)
+	}
+	b, ok := sc.byKey[encKey]
+	plain, plainOK := sc.byKey[plainKey]
+	sc.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+	var err error
+	if !plainOK {
+		if plain, err = render(); err != nil {
+			return nil, err
+		}
+	}
+	if b, err = compress(plain, encoding); err != nil {
+		return nil, err
+	}
+	sc.mu.Lock()
+	if sc.fillTime.Equal(fillTime) {
+		sc.byKey[plainKey], sc.byKey[encKey] = plain, b
+	}
+	sc.mu.Unlock()
+	return b, nil
+}
+
+// encodedETag returns the strong ETag of the representation of key in the encoding:
+// each encoding needs its own.
+func encodedETag(key, encoding string) string {
+	if encoding == "" {
+		return `"` + key + `"`
+	}
+	return `"` + key + "-" + encoding + `"`
+}
+
+// etagMatch reports whether the If-None-Match header matches the ETag.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		if t = strings.TrimPrefix(strings.TrimSpace(t), "W/"); t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
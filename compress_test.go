@@ -0,0 +1,204 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                             "",
+		"identity":                     "",
+		"identity;q=0":                 "",
+		"identity;q=0, gzip":           "gzip",
+		"gzip":                         "gzip",
+		"GZIP":                         "gzip",
+		"deflate, gzip":                "gzip",
+		"gzip, br":                     "br",
+		"br, gzip":                     "br",
+		"gzip, deflate, br, zstd":      "br",
+		"br;q=0.5, gzip":               "gzip",
+		"br;q=0.5, gzip;q=0.8":         "gzip",
+		"br;q=1.0, gzip;q=1":           "br",
+		"gzip; q=0.3, br ; q=0.2":      "gzip",
+		"br;q=0, gzip;q=0":             "",
+		"br;q=0":                       "",
+		"br;q=x, gzip;q=0.1":           "gzip",
+		"gzip;q=0.001, identity;q=0.5": "gzip",
+	} {
+		if got := negotiateEncoding(accept); got != want {
+			t.Errorf("%q: got %q, wanted %q", accept, got, want)
+		}
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	const etag = `"abc"`
+	for header, want := range map[string]bool{
+		``:                      false,
+		`"abc"`:                 true,
+		`W/"abc"`:               true,
+		`"abd"`:                 false,
+		`abc`:                   false,
+		`"x", "abc"`:            true,
+		`"x",W/"abc"`:           true,
+		`"x" , "y"`:             false,
+		`*`:                     true,
+		`"abc", *`:              true,
+		`W/"x", W/"y", W/"abc"`: true,
+	} {
+		if got := etagMatch(header, etag); got != want {
+			t.Errorf("%q: got %t, wanted %t", header, got, want)
+		}
+	}
+}
+
+func decompress(t *testing.T, b []byte, encoding string) string {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(b)
+	switch encoding {
+	case "br":
+		r = brotli.NewReader(r)
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(got)
+}
+
+func TestSnapshots(t *testing.T) {
+	var sc snapshots
+	var renders int
+	page := strings.Repeat("<tr><td>item</td></tr>", 100)
+	render := func() ([]byte, error) { renders++; return []byte(page), nil }
+	fillTime := time.Now()
+	for i, tc := range []struct {
+		fillTime      time.Time
+		key, encoding string
+		wantRenders   int
+	}{
+		{fillTime, "a", "br", 1},
+		{fillTime, "a", "gzip", 1},
+		{fillTime, "a", "", 1},
+		{fillTime, "a", "br", 1},
+		{fillTime, "b", "gzip", 2},
+		{fillTime.Add(time.Second), "a", "br", 3},
+		{fillTime.Add(time.Second), "a", "", 3},
+	} {
+		b, err := sc.Get(tc.fillTime, tc.key, tc.encoding, render)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decompress(t, b, tc.encoding); got != page {
+			t.Errorf("%d. got %q", i, got)
+		}
+		if tc.encoding != "" && len(b) >= len(page) {
+			t.Errorf("%d. %s is not compressed: %d bytes", i, tc.encoding, len(b))
+		}
+		if renders != tc.wantRenders {
+			t.Errorf("%d. got %d renders, wanted %d", i, renders, tc.wantRenders)
+		}
+	}
+}
+
+func TestCompressWriterFlush(t *testing.T) {
+	for _, encoding := range []string{"br", "gzip"} {
+		rec := httptest.NewRecorder()
+		w := &compressWriter{ResponseWriter: rec, encoding: encoding}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello, ")
+		w.Flush()
+		if !rec.Flushed || rec.Header().Get("Content-Encoding") != encoding {
+			t.Fatalf("%s: flushed: %t, encoding %q", encoding, rec.Flushed, rec.Header().Get("Content-Encoding"))
+		}
+		// what has been written so far is decodable before the stream is closed
+		var r io.Reader = bytes.NewReader(rec.Body.Bytes())
+		if encoding == "br" {
+			r = brotli.NewReader(r)
+		} else {
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = zr
+		}
+		got := make([]byte, len("hello, "))
+		if _, err := io.ReadFull(r, got); err != nil || string(got) != "hello, " {
+			t.Errorf("%s: got %q, %v after Flush", encoding, got, err)
+		}
+
+		io.WriteString(w, "world")
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := decompress(t, rec.Body.Bytes(), encoding); got != "hello, world" {
+			t.Errorf("%s: got %q", encoding, got)
+		}
+	}
+
+	// not compressible
+	rec := httptest.NewRecorder()
+	w := &compressWriter{ResponseWriter: rec, encoding: "gzip"}
+	w.Header().Set("Content-Type", "video/mp4")
+	io.WriteString(w, "data")
+	w.Flush()
+	if !rec.Flushed || rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "data" {
+		t.Errorf("got %q %q", rec.Header().Get("Content-Encoding"), rec.Body.String())
+	}
+}
+
+func TestIndexETag(t *testing.T) {
+	h := newHandler(&dlna.Client{})
+	if err := h.configure(defaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	h.library.Store(&library{data: []Folder{{Container: dlna.Container{ID: "64", Title: "Movies"}, Items: []dlna.Item{
+		{ID: "64$1", ParentID: "64", Title: strings.Repeat("Movie ", 100)},
+	}}}, fillTime: time.Now(), expires: time.Now().Add(time.Hour)})
+	get := func(accept, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	etags := make(map[string]string)
+	for _, encoding := range []string{"br", "gzip", ""} {
+		w := get(encoding, "")
+		etag := w.Header().Get("ETag")
+		if w.Code != 200 || w.Header().Get("Content-Encoding") != encoding || etag == "" {
+			t.Fatalf("%q: got %d %q %q", encoding, w.Code, w.Header().Get("Content-Encoding"), etag)
+		}
+		for other, otherETag := range etags {
+			if etag == otherETag {
+				t.Errorf("%q and %q have the same ETag %s", encoding, other, etag)
+			}
+		}
+		etags[encoding] = etag
+		if w := get(encoding, etag); w.Code != 304 {
+			t.Errorf("%q with its ETag: got %d", encoding, w.Code)
+		}
+	}
+	// the ETag of another encoding does not match
+	if w := get("", etags["br"]); w.Code != 200 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("identity with the br ETag: got %d %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,469 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of webdlna, read from a JSON file:
+//
+//	{
+//	  "servers": ["http://192.168.1.2:8200"],
+//	  "listen": [":8443"],
+//	  "tls": {"selfSigned": true, "redirect": [":8080"], "hsts": "4320h"},
+//	  "cache": {"ttl": "5m", "errorTTL": "30s"},
+//	  "upstream": {"timeout": "30s", "retries": 2, "workers": 4},
+//	  "rules": [{"action": "hide", "on": "container", "field": "title", "glob": "All *"}],
+//	  "auth": {"users": {"papa": "$2y$10$..."}, "tokens": {"s3cr3t": "kids"}, "allow": {"kids": ["Cartoons*"]}},
+//	  "features": {"dlna": true}
+//	}
+//
+// Everything can be overridden by WEBDLNA_* environment variables (see Config.applyEnv).
+//
+// On SIGHUP the file is read again, and the servers, cache, rules, auth, log level, HSTS, proxy and the crawler settings
+// are changed without dropping connections; the listeners, the TLS certificate configuration, the state directory,
+// the upstream timeout, the DLNA feature, the log format and the tracing need a restart.
+//
+// The listen addresses are [host]:port, "unix:/path/to/socket" or "systemd" (or "systemd:name")
+// for the sockets passed by systemd socket activation.
+// (The certificate files are reloaded when they change.)
+type Config struct {
+	Servers   []string `json:"servers"`
+	Listen    []string `json:"listen"`
+	Renderers []string `json:"renderers,omitempty"`
+	State     string   `json:"state,omitempty"`
+	// Socket is the ownership and permissions of the unix socket listeners.
+	Socket SocketConfig `json:"socket"`
+	TLS    TLSConfig    `json:"tls"`
+	// ShutdownTimeout is how long the in-flight requests are waited for on SIGTERM.
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+
+	Cache struct {
+		// TTL is how long the crawled library is served from the cache.
+		TTL Duration `json:"ttl"`
+		// ErrorTTL is the TTL of a library with failed folders.
+		ErrorTTL Duration `json:"errorTTL"`
+	} `json:"cache"`
+
+	Upstream struct {
+		Timeout  Duration `json:"timeout"`
+		Retries  int      `json:"retries"`
+		Backoff  Duration `json:"backoff"`
+		Workers  int      `json:"workers"`
+		Rate     float64  `json:"rate,omitempty"`
+		InFlight int      `json:"inflight,omitempty"`
+	} `json:"upstream"`
+
+	Health struct {
+		// ReadyTimeout is how long /readyz waits for the upstream servers' descriptions.
+		ReadyTimeout Duration `json:"readyTimeout"`
+	} `json:"health"`
+
+	// Rules hide or pin containers and items; the default rules are used if it's nil.
+	Rules []Rule `json:"rules,omitempty"`
+
+	Auth AuthConfig `json:"auth"`
+
+	Log struct {
+		// Format is "text" or "json"; changing it needs a restart.
+		Format string `json:"format,omitempty"`
+		// Level is debug, info, warn or error.
+		Level string `json:"level,omitempty"`
+	} `json:"log"`
+
+	Tracing struct {
+		// Exporter is "stdout" or "otlp"; tracing is disabled if it's empty. Changing it needs a restart.
+		Exporter string `json:"exporter,omitempty"`
+		// Endpoint is the OTLP/HTTP traces endpoint, http://localhost:4318/v1/traces by default.
+		Endpoint string `json:"endpoint,omitempty"`
+	} `json:"tracing"`
+
+	Proxy struct {
+		// BasePath is the URL prefix webdlna is served under behind a reverse proxy (e.g. "/webdlna"),
+		// stripped from the request paths having it.
+		BasePath string `json:"basePath,omitempty"`
+		// Trusted are the addresses or CIDRs of the reverse proxies whose
+		// X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers are believed.
+		Trusted []string `json:"trusted,omitempty"`
+	} `json:"proxy"`
+
+	Features struct {
+		// DLNA advertises webdlna as a DLNA MediaServer.
+		DLNA     bool   `json:"dlna,omitempty"`
+		DLNAName string `json:"dlnaName,omitempty"`
+		// NoDiscovery disables the SSDP search for renderers.
+		NoDiscovery bool `json:"noDiscovery,omitempty"`
+	} `json:"features"`
+}
+
+func defaultConfig() Config {
+	var c Config
+	c.Servers = []string{"http://127.0.0.1:8200"}
+	c.Listen = []string{":http"}
+	c.ShutdownTimeout = Duration(10 * time.Second)
+	c.Cache.TTL = Duration(5 * time.Minute)
+	c.Cache.ErrorTTL = Duration(30 * time.Second)
+	c.Upstream.Timeout = Duration(30 * time.Second)
+	c.Upstream.Retries = 2
+	c.Upstream.Backoff = Duration(500 * time.Millisecond)
+	c.Upstream.Workers = 1
+	c.Health.ReadyTimeout = Duration(2 * time.Second)
+	return c
+}
+
+// readFile reads the JSON configuration file over c.
+func (c *Config) readFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(c); err != nil {
+		return fmt.Errorf("parse %q: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides the configuration with the WEBDLNA_* environment variables.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	list := func(p *[]string) func(string) error {
+		return func(s string) error { *p = splitList(s); return nil }
+	}
+	str := func(p *string) func(string) error {
+		return func(s string) error { *p = s; return nil }
+	}
+	integer := func(p *int) func(string) error {
+		return func(s string) (err error) { *p, err = strconv.Atoi(s); return err }
+	}
+	boolean := func(p *bool) func(string) error {
+		return func(s string) (err error) { *p, err = strconv.ParseBool(s); return err }
+	}
+	vars := []struct {
+		name string
+		set  func(string) error
+	}{
+		{"WEBDLNA_SERVERS", list(&c.Servers)},
+		{"WEBDLNA_LISTEN", list(&c.Listen)},
+		{"WEBDLNA_RENDERERS", list(&c.Renderers)},
+		{"WEBDLNA_SOCKET_MODE", str(&c.Socket.Mode)},
+		{"WEBDLNA_SOCKET_GROUP", str(&c.Socket.Group)},
+		{"WEBDLNA_STATE", str(&c.State)},
+		{"WEBDLNA_TLS_CERT", str(&c.TLS.Cert)},
+		{"WEBDLNA_TLS_KEY", str(&c.TLS.Key)},
+		{"WEBDLNA_TLS_SELF_SIGNED", boolean(&c.TLS.SelfSigned)},
+		{"WEBDLNA_TLS_HOSTS", list(&c.TLS.Hosts)},
+		{"WEBDLNA_TLS_REDIRECT", list(&c.TLS.Redirect)},
+		{"WEBDLNA_HSTS", c.TLS.HSTS.Set},
+		{"WEBDLNA_SHUTDOWN_TIMEOUT", c.ShutdownTimeout.Set},
+		{"WEBDLNA_CACHE_TTL", c.Cache.TTL.Set},
+		{"WEBDLNA_CACHE_ERROR_TTL", c.Cache.ErrorTTL.Set},
+		{"WEBDLNA_TIMEOUT", c.Upstream.Timeout.Set},
+		{"WEBDLNA_RETRIES", integer(&c.Upstream.Retries)},
+		{"WEBDLNA_BACKOFF", c.Upstream.Backoff.Set},
+		{"WEBDLNA_WORKERS", integer(&c.Upstream.Workers)},
+		{"WEBDLNA_RATE", func(s string) (err error) { c.Upstream.Rate, err = strconv.ParseFloat(s, 64); return err }},
+		{"WEBDLNA_INFLIGHT", integer(&c.Upstream.InFlight)},
+		{"WEBDLNA_READY_TIMEOUT", c.Health.ReadyTimeout.Set},
+		{"WEBDLNA_BASE_PATH", str(&c.Proxy.BasePath)},
+		{"WEBDLNA_TRUSTED_PROXIES", list(&c.Proxy.Trusted)},
+		{"WEBDLNA_DLNA", boolean(&c.Features.DLNA)},
+		{"WEBDLNA_DLNA_NAME", str(&c.Features.DLNAName)},
+		{"WEBDLNA_NO_DISCOVERY", boolean(&c.Features.NoDiscovery)},
+		{"WEBDLNA_LOG_FORMAT", str(&c.Log.Format)},
+		{"WEBDLNA_LOG_LEVEL", str(&c.Log.Level)},
+		{"WEBDLNA_TRACE", str(&c.Tracing.Exporter)},
+		{"WEBDLNA_TRACE_ENDPOINT", str(&c.Tracing.Endpoint)},
+	}
+	for _, v := range vars {
+		if s, ok := lookup(v.name); ok {
+			if err := v.set(s); err != nil {
+				return fmt.Errorf("%s=%q: %w", v.name, s, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configFlags are the command line flags overriding the configuration.
+type configFlags struct {
+	fs              *flag.FlagSet
+	config          *string
+	miniDLNA        *string
+	renderers       *string
+	state           *string
+	tlsCert         *string
+	tlsKey          *string
+	tlsSelfSigned   *bool
+	tlsRedirect     *string
+	timeout         *time.Duration
+	retries         *int
+	backoff         *time.Duration
+	workers         *int
+	rate            *float64
+	inFlight        *int
+	shutdownTimeout *time.Duration
+	cache           *time.Duration
+	rules           *string
+	socketMode      *string
+	socketGroup     *string
+	basePath        *string
+	trustedProxies  *string
+	dlna            *bool
+	dlnaName        *string
+	logFormat       *string
+	logLevel        *string
+	trace           *string
+	traceEndpoint   *string
+}
+
+// newConfigFlags defines the flags on fs.
+func newConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := configFlags{fs: fs}
+	f.config = fs.String("config", "", "JSON configuration file, reloaded on SIGHUP")
+	f.miniDLNA = fs.String("minidlna", "http://127.0.0.1:8200", "comma-separated list of MiniDLNA server addresses")
+	f.renderers = fs.String("renderers", "", "comma-separated list of MediaRenderer description URLs, besides the ones found by SSDP")
+	f.state = fs.String("state", "", "directory to store the state (play queues, shares, self-signed certificate) in")
+	f.tlsCert = fs.String("tls-cert", "", "PEM certificate file, serving HTTPS (reloaded when it changes)")
+	f.tlsKey = fs.String("tls-key", "", "PEM key file of the certificate")
+	f.tlsSelfSigned = fs.Bool("tls-self-signed", false, "serve HTTPS with a generated self-signed certificate, if there are no files")
+	f.tlsRedirect = fs.String("tls-redirect", "", "comma-separated list of plain HTTP listen addresses, redirecting to HTTPS")
+	f.timeout = fs.Duration("timeout", 30*time.Second, "timeout of one call to an upstream server or renderer")
+	f.retries = fs.Int("retries", 2, "number of retries of the failed Browse calls")
+	f.backoff = fs.Duration("backoff", 500*time.Millisecond, "wait before the first retry, doubled for each subsequent one")
+	f.workers = fs.Int("workers", 1, "number of concurrent Browse calls per upstream server")
+	f.rate = fs.Float64("rate", 0, "maximum number of requests per second per upstream server (0: unlimited)")
+	f.inFlight = fs.Int("inflight", 0, "maximum number of in-flight requests per upstream server (0: unlimited)")
+	f.shutdownTimeout = fs.Duration("shutdown-timeout", 10*time.Second, "how long the in-flight requests are waited for on SIGTERM")
+	f.cache = fs.Duration("cache", 5*time.Minute, "how long the crawled library is served from the cache")
+	f.rules = fs.String("rules", "", "JSON file of the rules hiding or pinning containers and items (default: hide the \"All *\" containers and the thumbnails)")
+	f.socketMode = fs.String("socket-mode", "", "permissions of the unix sockets (default 0660)")
+	f.socketGroup = fs.String("socket-group", "", "group owning the unix sockets")
+	f.basePath = fs.String("base-path", "", "URL prefix webdlna is served under behind a reverse proxy")
+	f.trustedProxies = fs.String("trusted-proxies", "", "comma-separated list of the reverse proxies' addresses (CIDRs), whose X-Forwarded-* headers are believed")
+	f.dlna = fs.Bool("dlna", false, "advertise as a DLNA MediaServer, re-exporting the aggregated library")
+	f.dlnaName = fs.String("dlna-name", "", "friendly name of the DLNA MediaServer (default: webdlna on <hostname>)")
+	f.logFormat = fs.String("log-format", "text", "log format: text or json")
+	f.logLevel = fs.String("log-level", "info", "log level: debug, info, warn or error")
+	f.trace = fs.String("trace", "", "export the trace spans to stdout or otlp (default: no tracing)")
+	f.traceEndpoint = fs.String("trace-endpoint", "", "OTLP/HTTP traces endpoint (default: http://localhost:4318/v1/traces)")
+	return &f
+}
+
+// apply overrides the configuration with the explicitly set flags, and the listen addresses with the arguments.
+func (f *configFlags) apply(c *Config) error {
+	var err error
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "minidlna":
+			c.Servers = splitList(*f.miniDLNA)
+		case "renderers":
+			c.Renderers = splitList(*f.renderers)
+		case "state":
+			c.State = *f.state
+		case "tls-cert":
+			c.TLS.Cert = *f.tlsCert
+		case "tls-key":
+			c.TLS.Key = *f.tlsKey
+		case "tls-self-signed":
+			c.TLS.SelfSigned = *f.tlsSelfSigned
+		case "tls-redirect":
+			c.TLS.Redirect = splitList(*f.tlsRedirect)
+		case "timeout":
+			c.Upstream.Timeout = Duration(*f.timeout)
+		case "retries":
+			c.Upstream.Retries = *f.retries
+		case "backoff":
+			c.Upstream.Backoff = Duration(*f.backoff)
+		case "workers":
+			c.Upstream.Workers = *f.workers
+		case "rate":
+			c.Upstream.Rate = *f.rate
+		case "inflight":
+			c.Upstream.InFlight = *f.inFlight
+		case "shutdown-timeout":
+			c.ShutdownTimeout = Duration(*f.shutdownTimeout)
+		case "cache":
+			c.Cache.TTL = Duration(*f.cache)
+		case "rules":
+			if c.Rules, err = readRules(*f.rules); err != nil {
+				err = fmt.Errorf("rules: %w", err)
+			}
+		case "socket-mode":
+			c.Socket.Mode = *f.socketMode
+		case "socket-group":
+			c.Socket.Group = *f.socketGroup
+		case "base-path":
+			c.Proxy.BasePath = *f.basePath
+		case "trusted-proxies":
+			c.Proxy.Trusted = splitList(*f.trustedProxies)
+		case "dlna":
+			c.Features.DLNA = *f.dlna
+		case "dlna-name":
+			c.Features.DLNAName = *f.dlnaName
+		case "log-format":
+			c.Log.Format = *f.logFormat
+		case "log-level":
+			c.Log.Level = *f.logLevel
+		case "trace":
+			c.Tracing.Exporter = *f.trace
+		case "trace-endpoint":
+			c.Tracing.Endpoint = *f.traceEndpoint
+		}
+	})
+	if f.fs.NArg() != 0 {
+		c.Listen = f.fs.Args()
+	}
+	return err
+}
+
+// loadConfig reads the configuration: the defaults, overridden by the file of the -config flag,
+// the environment and the explicitly set flags, in this order; and checks it.
+func loadConfig(f *configFlags, lookup func(string) (string, bool)) (Config, error) {
+	cfg := defaultConfig()
+	if *f.config != "" {
+		if err := cfg.readFile(*f.config); err != nil {
+			return cfg, err
+		}
+	}
+	if err := cfg.applyEnv(lookup); err != nil {
+		return cfg, err
+	}
+	if err := f.apply(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+// validate checks the values that would be accepted by the parsing.
+func (c Config) validate() error {
+	u := c.Upstream
+	switch {
+	case u.Timeout < 0:
+		return fmt.Errorf("negative upstream timeout %s", u.Timeout)
+	case u.Retries < 0:
+		return fmt.Errorf("negative number of retries %d", u.Retries)
+	case u.Backoff < 0:
+		return fmt.Errorf("negative backoff %s", u.Backoff)
+	case u.Workers < 0:
+		return fmt.Errorf("negative number of workers %d", u.Workers)
+	case u.Rate < 0 || math.IsNaN(u.Rate) || math.IsInf(u.Rate, 0):
+		return fmt.Errorf("invalid rate %v", u.Rate)
+	case u.InFlight < 0:
+		return fmt.Errorf("negative in-flight limit %d", u.InFlight)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// settings returns the reloadable settings of the configuration.
+func (c Config) settings() (*settings, error) {
+	if len(c.Servers) == 0 {
+		return nil, errors.New("no servers are configured")
+	}
+	rs := defaultRules
+	if c.Rules != nil {
+		rs = c.Rules
+	}
+	compiled, err := compileRules(rs)
+	if err != nil {
+		return nil, err
+	}
+	var level slog.Level
+	if c.Log.Level != "" {
+		if err = level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+			return nil, err
+		}
+	}
+	s := settings{
+		servers:         c.Servers,
+		cacheDur:        time.Duration(c.Cache.TTL),
+		errorCacheDur:   time.Duration(c.Cache.ErrorTTL),
+		shutdownTimeout: time.Duration(c.ShutdownTimeout),
+		readyTimeout:    time.Duration(c.Health.ReadyTimeout),
+		hsts:            time.Duration(c.TLS.HSTS),
+		basePath:        cleanPrefix(c.Proxy.BasePath),
+		logLevel:        level,
+		rules:           compiled,
+		discover:        !c.Features.NoDiscovery,
+		crawl: crawlConfig{
+			Workers: c.Upstream.Workers, Rate: c.Upstream.Rate, InFlight: c.Upstream.InFlight,
+			Retries: c.Upstream.Retries, Backoff: time.Duration(c.Upstream.Backoff),
+			Skip: compiled.HideContainer,
+		},
+	}
+	if s.trusted, err = parsePrefixes(c.Proxy.Trusted); err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+	if s.auth, err = c.Auth.compile(); err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	if c.TLS.enabled() && c.Features.DLNA && len(c.TLS.Redirect) == 0 {
+		return nil, errors.New("the DLNA feature with TLS needs a plain HTTP listener (tls.redirect)")
+	}
+	if s.auth != nil && c.Features.DLNA && c.Auth.DLNAUser == "" {
+		return nil, errors.New("the DLNA feature with authentication needs auth.dlnaUser")
+	}
+	return &s, nil
+}
+
+// settings is the part of the configuration that can be changed by a reload.
+type settings struct {
+	servers                 []string
+	cacheDur, errorCacheDur time.Duration
+	shutdownTimeout         time.Duration
+	readyTimeout            time.Duration
+	hsts                    time.Duration
+	basePath                string
+	trusted                 []netip.Prefix
+	logLevel                slog.Level
+	crawl                   crawlConfig
+	rules                   rules
+	discover                bool
+	auth                    *authenticator
+}
+
+// Duration is a time.Duration in JSON and in the environment as "1m30s".
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
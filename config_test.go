@@ -0,0 +1,114 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLoad loads the configuration from the file content (if not empty), the environment and the arguments.
+func testLoad(t *testing.T, file string, env map[string]string, args ...string) (Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("webdlna", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	flags := newConfigFlags(fs)
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "webdlna.json")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config=" + path}, args...)
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(flags, func(k string) (string, bool) { v, ok := env[k]; return v, ok })
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	const file = `{"servers": ["http://file:8200"], "listen": [":1"], "cache": {"ttl": "1m"},
+		"upstream": {"retries": 5, "backoff": "1s", "workers": 3, "rate": 10}, "log": {"level": "warn"}}`
+	env := map[string]string{"WEBDLNA_RETRIES": "6", "WEBDLNA_BACKOFF": "2s", "WEBDLNA_CACHE_TTL": "2m", "WEBDLNA_LOG_LEVEL": "error"}
+
+	cfg, err := testLoad(t, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := defaultConfig()
+	if !slices.Equal(cfg.Servers, def.Servers) || !slices.Equal(cfg.Listen, def.Listen) ||
+		cfg.Upstream != def.Upstream || cfg.Cache != def.Cache || cfg.Log.Level != "" {
+		t.Errorf("defaults: got %+v", cfg)
+	}
+
+	cfg, err = testLoad(t, file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cfg.Servers, []string{"http://file:8200"}) || cfg.Upstream.Retries != 5 || cfg.Upstream.Workers != 3 ||
+		cfg.Upstream.Timeout != def.Upstream.Timeout || cfg.Cache.ErrorTTL != def.Cache.ErrorTTL {
+		t.Errorf("file: got %+v", cfg)
+	}
+
+	cfg, err = testLoad(t, file, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Upstream.Retries != 6 || cfg.Upstream.Backoff != Duration(2*time.Second) || cfg.Upstream.Workers != 3 ||
+		cfg.Cache.TTL != Duration(2*time.Minute) || cfg.Log.Level != "error" {
+		t.Errorf("env: got %+v", cfg)
+	}
+
+	// the flags set explicitly win, even with their default value; the others don't override anything
+	cfg, err = testLoad(t, file, env, "-retries=7", "-workers=1", "-minidlna=http://a:8200,http://b:8200", ":2", "unix:/run/webdlna.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Upstream.Retries != 7 || cfg.Upstream.Workers != 1 || cfg.Upstream.Backoff != Duration(2*time.Second) ||
+		cfg.Upstream.Rate != 10 || cfg.Cache.TTL != Duration(2*time.Minute) || cfg.Log.Level != "error" ||
+		!slices.Equal(cfg.Servers, []string{"http://a:8200", "http://b:8200"}) ||
+		!slices.Equal(cfg.Listen, []string{":2", "unix:/run/webdlna.sock"}) {
+		t.Errorf("flags: got %+v", cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, file string
+		env        map[string]string
+		args       []string
+		want       string
+	}{
+		{name: "unknown field", file: `{"upstream": {"retry": 1}}`, want: "unknown field"},
+		{name: "bad duration", file: `{"upstream": {"backoff": "1"}}`, want: "missing unit"},
+		{name: "bad env", env: map[string]string{"WEBDLNA_WORKERS": "many"}, want: "WEBDLNA_WORKERS"},
+		{name: "negative backoff in the file", file: `{"upstream": {"backoff": "-1s"}}`, want: "backoff"},
+		{name: "negative backoff in the env", env: map[string]string{"WEBDLNA_BACKOFF": "-1s"}, want: "backoff"},
+		{name: "negative backoff flag", args: []string{"-backoff=-1s"}, want: "backoff"},
+		{name: "negative retries", file: `{"upstream": {"retries": -1}}`, want: "retries"},
+		{name: "negative workers", env: map[string]string{"WEBDLNA_WORKERS": "-2"}, want: "workers"},
+		{name: "negative rate", args: []string{"-rate=-0.5"}, want: "rate"},
+		{name: "NaN rate", env: map[string]string{"WEBDLNA_RATE": "NaN"}, want: "rate"},
+		{name: "negative in-flight", args: []string{"-inflight=-1"}, want: "in-flight"},
+		{name: "negative timeout", args: []string{"-timeout=-1s"}, want: "timeout"},
+		// a later source can fix an earlier one
+		{name: "fixed by the flags", file: `{"upstream": {"retries": -1}}`, args: []string{"-retries=1"}},
+	} {
+		_, err := testLoad(t, tc.file, tc.env, tc.args...)
+		if tc.want == "" {
+			if err != nil {
+				t.Errorf("%s: %+v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, wanted %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+// crawlConfig is the reloadable configuration of the crawler.
+//
+// On a fast server 8 workers took 4.7s, with no concurrency it was 2.8s,
+// but slow NAS boxes benefit from concurrency - so it's configurable.
+type crawlConfig struct {
+	// Workers is the number of concurrent Browse calls per server.
+	Workers int
+	// Rate is the maximum number of requests per second per server, 0 means unlimited.
+	Rate float64
+	// InFlight is the maximum number of in-flight requests per server, 0 means unlimited.
+	InFlight int
+	// Retries is the number of retries of a failed call, waiting Backoff, 2*Backoff, 4*Backoff... in between.
+	Retries int
+	Backoff time.Duration
+	// Skip reports whether the container (with its ID as webdlna shows it) should not be crawled.
+	Skip func(dlna.Container) bool
+}
+
+// crawler walks the content directories of the upstream servers.
+// It lives as long as the handler, keeping its stats, caches and limiters over the reloads.
+type crawler struct {
+	client *dlna.Client
+
+	mu       sync.Mutex
+	conf     crawlConfig
+	limiters map[string]*limiter
+	stats    map[string]CrawlStats
+	// okStats and errStats are the stats of the last successful and failed crawls.
+	okStats  map[string]CrawlStats
+	errStats map[string]CrawlStats
+	roots    map[string]dlna.Root
+	sortCaps map[string][]string
+	// sorted is the cache of the upstream sorted folders of the snapshot of sortedTime.
+	sorted     map[string]dlna.DIDLLite
+	sortedTime time.Time
+}
+
+// CrawlStats is the timing of the last crawl of a server.
+type CrawlStats struct {
+	Start    time.Time
+	Duration time.Duration
+	Calls    int
+	// CallTime is the sum of the Browse calls' durations.
+	CallTime time.Duration
+	// Slowest is the duration of the slowest Browse call, for SlowestID.
+	Slowest   time.Duration
+	SlowestID string
+	Folders   int
+	Items     int
+	Err       error
+}
+
+func (s CrawlStats) String() string {
+	return fmt.Sprintf("%d folders, %d items in %s: %d calls (avg %s, max %s for %q)",
+		s.Folders, s.Items, s.Duration, s.Calls, s.AvgCall(), s.Slowest, s.SlowestID)
+}
+
+// AvgCall returns the average duration of the Browse calls.
+func (s CrawlStats) AvgCall() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.CallTime / time.Duration(s.Calls)
+}
+
+// End returns the end of the crawl.
+func (s CrawlStats) End() time.Time { return s.Start.Add(s.Duration) }
+
+// Configure changes the configuration; the limiters are rebuilt if their limits changed.
+func (c *crawler) Configure(conf crawlConfig) {
+	c.mu.Lock()
+	if conf.Rate != c.conf.Rate || conf.InFlight != c.conf.InFlight {
+		c.limiters = nil
+	}
+	c.conf = conf
+	c.mu.Unlock()
+}
+
+func (c *crawler) config() crawlConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conf
+}
+
+// Stats returns the stats of the last crawl of each server.
+func (c *crawler) Stats() map[string]CrawlStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[string]CrawlStats, len(c.stats))
+	for k, v := range c.stats {
+		m[k] = v
+	}
+	return m
+}
+
+// ServerStatus is what the crawler knows about a server.
+type ServerStatus struct {
+	URL  string
+	Root dlna.Root
+	// Last, LastOK and LastErr are the stats of the last, the last successful and the last failed crawl;
+	// zero if there was no such crawl.
+	Last, LastOK, LastErr CrawlStats
+}
+
+// Status returns the status of the server.
+func (c *crawler) Status(baseURL string) ServerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ServerStatus{
+		URL: baseURL, Root: c.roots[baseURL],
+		Last: c.stats[baseURL], LastOK: c.okStats[baseURL], LastErr: c.errStats[baseURL],
+	}
+}
+
+func (c *crawler) limiter(baseURL string) *limiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l := c.limiters[baseURL]; l != nil {
+		return l
+	}
+	if c.limiters == nil {
+		c.limiters = make(map[string]*limiter)
+	}
+	l := &limiter{}
+	if c.conf.InFlight > 0 {
+		l.sem = make(chan struct{}, c.conf.InFlight)
+	}
+	if c.conf.Rate > 0 {
+		l.interval = time.Duration(float64(time.Second) / c.conf.Rate)
+	}
+	c.limiters[baseURL] = l
+	return l
+}
+
+// Crawl retrieves the folders of all the servers, concurrently.
+// With more than one server, the object IDs are prefixed with the server's index.
+//
+// The folders (and servers) that could not be retrieved are returned with their Err set;
+// the returned error is non-nil only if no server could be reached.
+func (c *crawler) Crawl(ctx context.Context, servers []string) ([]Folder, error) {
+	if len(servers) == 1 {
+		return c.folders(ctx, servers[0], "")
+	}
+	results := make([][]Folder, len(servers))
+	errs := make([]error, len(servers))
+	parallel(ctx, len(servers), len(servers), func(ctx context.Context, i int) {
+		results[i], errs[i] = c.folders(ctx, servers[i], strconv.Itoa(i)+":")
+	})
+	var all []Folder
+	var failed int
+	for n, data := range results {
+		if errs[n] != nil {
+			failed++
+			all = append(all, Folder{
+				Container: dlna.Container{ID: strconv.Itoa(n) + ":0", Title: servers[n]},
+				Err:       errs[n],
+			})
+			continue
+		}
+		for _, f := range data {
+			all = append(all, f.qualify(n))
+		}
+	}
+	if failed == len(servers) {
+		return nil, errors.Join(errs...)
+	}
+	return all, nil
+}
+
+// retry calls f until it succeeds, ctx is done or it failed Retries+1 times,
+// with exponential backoff (with jitter) in between.
+//
+// UPnP errors are not retried.
+func (c *crawler) retry(ctx context.Context, f func(context.Context) error) error {
+	conf := c.config()
+	wait := max(conf.Backoff, 0)
+	for i := 0; ; i++ {
+		err := f(ctx)
+		if err == nil || i >= conf.Retries || ctx.Err() != nil {
+			return err
+		}
+		var ue *dlna.UPnPError
+		if errors.As(err, &ue) {
+			return err
+		}
+		d := wait/2 + rand.N(wait/2+1)
+		slog.InfoContext(ctx, "retry", "attempt", i+1, "wait", d, "error", err)
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		if wait <= math.MaxInt64/2 {
+			wait *= 2
+		}
+	}
+}
+
+// describe fetches the root description of the server, and remembers it for Metadata.
+func (c *crawler) describe(ctx context.Context, baseURL string) (dlna.Root, error) {
+	var root dlna.Root
+	if err := c.retry(ctx, func(ctx context.Context) error {
+		var err error
+		root, err = getRootDesc(ctx, c.client, baseURL)
+		return err
+	}); err != nil {
+		return root, err
+	}
+	c.mu.Lock()
+	if c.roots == nil {
+		c.roots = make(map[string]dlna.Root)
+	}
+	c.roots[baseURL] = root
+	c.mu.Unlock()
+	return root, nil
+}
+
+// Metadata returns the object with the server's own ID, with BrowseMetadata,
+// obeying the server's limits.
+func (c *crawler) Metadata(ctx context.Context, baseURL, id string) (dlna.DIDLLite, error) {
+	c.mu.Lock()
+	root, ok := c.roots[baseURL]
+	c.mu.Unlock()
+	if !ok {
+		var err error
+		if root, err = c.describe(ctx, baseURL); err != nil {
+			return dlna.DIDLLite{}, err
+		}
+	}
+	lim := c.limiter(baseURL)
+	var dl dlna.DIDLLite
+	err := c.retry(ctx, func(ctx context.Context) error {
+		release, err := lim.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		ctx, sp := startSpan(ctx, "BrowseMetadata", spanKindInternal, spanAttr{"upstream", baseURL}, spanAttr{"objectID", id})
+		dl, err = c.client.BrowseMetadata(ctx, root, id)
+		sp.SetAttr("items", len(dl.Items))
+		sp.End(err)
+		return err
+	})
+	if err != nil {
+		return dl, fmt.Errorf("metadata %q: %w", id, err)
+	}
+	return dl, nil
+}
+
+// folders returns the non-empty folders of the server, in the server's order.
+// The IDs are checked by Skip with the prefix prepended.
+func (c *crawler) folders(ctx context.Context, baseURL, prefix string) ([]Folder, error) {
+	conf := c.config()
+	ctx, sp := startSpan(ctx, "crawl", spanKindInternal, spanAttr{"upstream", baseURL})
+	stats := CrawlStats{Start: time.Now()}
+	var statsMu sync.Mutex
+	defer func() {
+		stats.Duration = time.Since(stats.Start)
+		sp.SetAttr("folders", stats.Folders)
+		sp.SetAttr("items", stats.Items)
+		sp.SetAttr("calls", stats.Calls)
+		sp.End(stats.Err)
+		slog.InfoContext(ctx, "crawled", "upstream", baseURL, "workers", max(1, conf.Workers),
+			"folders", stats.Folders, "items", stats.Items, "duration", stats.Duration,
+			"calls", stats.Calls, "avgCall", stats.AvgCall(), "slowest", stats.Slowest, "slowestObjectID", stats.SlowestID,
+			"error", stats.Err)
+		host := baseURL
+		if u, err := url.Parse(baseURL); err == nil {
+			host = u.Host
+		}
+		metrics.crawlDuration.Observe(stats.Duration.Seconds(), host)
+		c.mu.Lock()
+		if c.stats == nil {
+			c.stats = make(map[string]CrawlStats)
+			c.okStats = make(map[string]CrawlStats)
+			c.errStats = make(map[string]CrawlStats)
+		}
+		c.stats[baseURL] = stats
+		if stats.Err == nil {
+			c.okStats[baseURL] = stats
+		} else {
+			c.errStats[baseURL] = stats
+		}
+		c.mu.Unlock()
+	}()
+
+	lim := c.limiter(baseURL)
+	root, err := c.describe(ctx, baseURL)
+	if err != nil {
+		stats.Err = err
+		return nil, err
+	}
+	browse := func(ctx context.Context, id string) (dlna.DIDLLite, error) {
+		var dl dlna.DIDLLite
+		err := c.retry(ctx, func(ctx context.Context) error {
+			release, err := lim.acquire(ctx)
+			if err != nil {
+				return err
+			}
+			ctx, sp := startSpan(ctx, "Browse", spanKindInternal, spanAttr{"upstream", baseURL}, spanAttr{"objectID", id})
+			start := time.Now()
+			var res dlna.Result
+			res, err = c.client.Browse(ctx, root, dlna.BrowseRequest{ObjectID: id})
+			dl = res.DIDLLite
+			dur := time.Since(start)
+			release()
+			sp.SetAttr("containers", len(res.Containers))
+			sp.SetAttr("items", len(res.Items))
+			sp.SetAttr("totalMatches", res.TotalMatches)
+			sp.End(err)
+			slog.DebugContext(ctx, "browse", "upstream", baseURL, "objectID", id, "duration", dur, "error", err)
+			statsMu.Lock()
+			stats.Calls++
+			stats.CallTime += dur
+			if dur > stats.Slowest {
+				stats.Slowest, stats.SlowestID = dur, id
+			}
+			statsMu.Unlock()
+			return err
+		})
+		if err != nil {
+			return dl, fmt.Errorf("browse %q: %w", id, err)
+		}
+		return dl, nil
+	}
+
+	dl, err := browse(ctx, "0")
+	if err != nil {
+		stats.Err = err
+		return nil, err
+	}
+
+	lists := make([]dlna.DIDLLite, len(dl.Containers))
+	listErrs := make([]error, len(dl.Containers))
+	parallel(ctx, conf.Workers, len(dl.Containers), func(ctx context.Context, i int) {
+		if lists[i], listErrs[i] = browse(ctx, dl.Containers[i].ID); listErrs[i] != nil {
+			slog.WarnContext(ctx, "browse", "upstream", baseURL, "error", listErrs[i])
+		}
+	})
+	var data []Folder
+	for i, fl := range lists {
+		if listErrs[i] != nil {
+			data = append(data, Folder{Container: dl.Containers[i], Err: listErrs[i]})
+			continue
+		}
+		for _, folder := range fl.Containers {
+			q := folder
+			q.ID = prefix + q.ID
+			if conf.Skip == nil || !conf.Skip(q) {
+				data = append(data, Folder{Container: folder})
+			}
+		}
+	}
+
+	parallel(ctx, conf.Workers, len(data), func(ctx context.Context, i int) {
+		if data[i].Err != nil {
+			return
+		}
+		ff, err := browse(ctx, data[i].ID)
+		if err != nil {
+			slog.WarnContext(ctx, "browse", "upstream", baseURL, "error", err)
+			data[i].Err = err
+			return
+		}
+		data[i].Items = ff.Items
+	})
+	if err := ctx.Err(); err != nil {
+		stats.Err = err
+		return nil, err
+	}
+	nonEmpty := data[:0]
+	for _, f := range data {
+		if len(f.Items) != 0 || f.Err != nil {
+			nonEmpty = append(nonEmpty, f)
+			stats.Items += len(f.Items)
+		}
+	}
+	stats.Folders = len(nonEmpty)
+	return nonEmpty, nil
+}
+
+// parallel calls f for each i in [0, n) on at most workers goroutines,
+// until ctx is canceled.
+func parallel(ctx context.Context, workers, n int, f func(ctx context.Context, i int)) {
+	if workers <= 1 {
+		for i := 0; i < n && ctx.Err() == nil; i++ {
+			f(ctx, i)
+		}
+		return
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				f(ctx, i)
+			}
+		}()
+	}
+	defer func() { close(indices); wg.Wait() }()
+	for i := range n {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// limiter limits the rate and the number of in-flight requests to a server.
+type limiter struct {
+	sem      chan struct{}
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// acquire waits until a request can be started, and returns the function to call when it's finished.
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if l.sem != nil {
+			<-l.sem
+		}
+	}
+	if l.interval <= 0 {
+		return release, nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	t := l.next
+	if t.Before(now) {
+		t = now
+	}
+	l.next = t.Add(l.interval)
+	l.mu.Unlock()
+	if wait := t.Sub(now); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
@@ -0,0 +1,258 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func xmlResponse(code int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: code, Status: http.StatusText(code),
+		Header: http.Header{"Content-Type": {dlna.ContentType}},
+		Body:   io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func soapResponse(body string) *http.Response {
+	return xmlResponse(http.StatusOK, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+		body+`</s:Body></s:Envelope>`)
+}
+
+func testCrawler(rt http.RoundTripper, conf crawlConfig) *crawler {
+	c := &crawler{client: &dlna.Client{HTTPClient: &http.Client{Transport: rt}}}
+	c.Configure(conf)
+	return c
+}
+
+func TestCrawlerRetry(t *testing.T) {
+	errDown := errors.New("connection refused")
+	for _, tc := range []struct {
+		name     string
+		failures int
+		retries  int
+		backoff  time.Duration
+		attempts int
+		ok       bool
+	}{
+		{"no failure", 0, 3, time.Millisecond, 1, true},
+		{"recovers", 2, 3, time.Millisecond, 3, true},
+		{"recovers on the last", 3, 3, time.Millisecond, 4, true},
+		{"gives up", 5, 2, time.Millisecond, 3, false},
+		{"no retries", 1, 0, time.Millisecond, 1, false},
+		{"no backoff", 2, 2, 0, 3, true},
+		{"negative backoff", 2, 2, -time.Second, 3, true},
+		{"negative retries", 1, -1, time.Millisecond, 1, false},
+	} {
+		var mu sync.Mutex
+		var attempts int
+		c := testCrawler(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts++; attempts <= tc.failures {
+				return nil, errDown
+			}
+			return xmlResponse(http.StatusOK, fakeServerDesc), nil
+		}), crawlConfig{Retries: tc.retries, Backoff: tc.backoff})
+		_, err := c.describe(context.Background(), "http://192.0.2.1:8200")
+		if attempts != tc.attempts || (err == nil) != tc.ok {
+			t.Errorf("%s: got %d attempts, %v; wanted %d, ok=%t", tc.name, attempts, err, tc.attempts, tc.ok)
+		}
+		if err != nil && !errors.Is(err, errDown) {
+			t.Errorf("%s: got %v, wanted %v", tc.name, err, errDown)
+		}
+	}
+}
+
+func TestCrawlerRetryUPnPError(t *testing.T) {
+	var calls int
+	c := testCrawler(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method == "GET" {
+			return xmlResponse(http.StatusOK, fakeServerDesc), nil
+		}
+		calls++
+		resp := soapResponse(`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+			`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>701</errorCode></UPnPError></detail></s:Fault>`)
+		resp.StatusCode, resp.Status = http.StatusInternalServerError, "500 Internal Server Error"
+		return resp, nil
+	}), crawlConfig{Retries: 3, Backoff: time.Millisecond})
+	_, err := c.Metadata(context.Background(), "http://192.0.2.1:8200", "1")
+	var ue *dlna.UPnPError
+	if !errors.As(err, &ue) || calls != 1 {
+		t.Errorf("got %d calls, %v; wanted 1 call and an UPnP error", calls, err)
+	}
+}
+
+func TestCrawlerRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var attempts int
+	c := testCrawler(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, errors.New("connection refused")
+	}), crawlConfig{Retries: 5, Backoff: time.Hour})
+	go func() { time.Sleep(10 * time.Millisecond); cancel() }()
+	start := time.Now()
+	if _, err := c.describe(ctx, "http://192.0.2.1:8200"); err == nil || attempts != 1 || time.Since(start) > time.Second {
+		t.Errorf("got %d attempts in %s, %v", attempts, time.Since(start), err)
+	}
+}
+
+var objectIDRe = regexp.MustCompile(`<ObjectID>([^<]*)</ObjectID>`)
+
+// fakeLibrary answers the Browse calls with a tree of three containers, each with three folders of two items,
+// after a random delay; it records the maximal number of the concurrent calls.
+type fakeLibrary struct {
+	mu            sync.Mutex
+	calls         int
+	inFlight, max int
+	times         []time.Time
+}
+
+func (fl *fakeLibrary) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method == "GET" {
+		return xmlResponse(http.StatusOK, fakeServerDesc), nil
+	}
+	fl.mu.Lock()
+	fl.calls++
+	fl.inFlight++
+	fl.max = max(fl.max, fl.inFlight)
+	fl.times = append(fl.times, time.Now())
+	fl.mu.Unlock()
+	defer func() { fl.mu.Lock(); fl.inFlight--; fl.mu.Unlock() }()
+	time.Sleep(time.Duration(rand.IntN(3)) * time.Millisecond)
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	m := objectIDRe.FindSubmatch(b)
+	if m == nil {
+		return nil, fmt.Errorf("no ObjectID in %s", b)
+	}
+	id := string(m[1])
+	var didl strings.Builder
+	n := 3
+	switch depth := strings.Count(id, "."); {
+	case id == "0":
+		for i := 1; i <= n; i++ {
+			fmt.Fprintf(&didl, `<container id="%d" parentID="0"><dc:title>c%d</dc:title></container>`, i, i)
+		}
+	case depth == 0:
+		for i := 1; i <= n; i++ {
+			fmt.Fprintf(&didl, `<container id="%s.%d" parentID="%s"><dc:title>f%s.%d</dc:title></container>`, id, i, id, id, i)
+		}
+	default:
+		n = 2
+		for i := 1; i <= n; i++ {
+			fmt.Fprintf(&didl, `<item id="%s.%d" parentID="%s"><dc:title>i%s.%d</dc:title></item>`, id, i, id, id, i)
+		}
+	}
+	var escaped strings.Builder
+	escaped.WriteString(`&lt;DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/"&gt;`)
+	escaped.WriteString(strings.NewReplacer("<", "&lt;", ">", "&gt;").Replace(didl.String()))
+	escaped.WriteString(`&lt;/DIDL-Lite&gt;`)
+	return soapResponse(fmt.Sprintf(`<u:BrowseResponse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1"><Result>%s</Result>`+
+		`<NumberReturned>%d</NumberReturned><TotalMatches>%d</TotalMatches><UpdateID>1</UpdateID></u:BrowseResponse>`,
+		escaped.String(), n, n)), nil
+}
+
+// ids returns the folder and item IDs in order.
+func ids(data []Folder) []string {
+	var got []string
+	for _, f := range data {
+		got = append(got, f.ID)
+		for _, it := range f.Items {
+			got = append(got, " "+it.ID)
+		}
+	}
+	return got
+}
+
+func TestCrawlOrder(t *testing.T) {
+	var want []string
+	for i := 1; i <= 3; i++ {
+		for j := 1; j <= 3; j++ {
+			f := fmt.Sprintf("%d.%d", i, j)
+			want = append(want, f, " "+f+".1", " "+f+".2")
+		}
+	}
+	for _, tc := range []struct {
+		workers, inFlight int
+	}{
+		{0, 0},
+		{1, 0},
+		{8, 0},
+		{8, 2},
+		{3, 1},
+	} {
+		var fl fakeLibrary
+		c := testCrawler(&fl, crawlConfig{Workers: tc.workers, InFlight: tc.inFlight})
+		data, err := c.Crawl(context.Background(), []string{"http://192.0.2.1:8200"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(data); !slices.Equal(got, want) {
+			t.Errorf("%+v: got %q, wanted %q", tc, got, want)
+		}
+		if fl.calls != 1+3+9 {
+			t.Errorf("%+v: got %d calls", tc, fl.calls)
+		}
+		if limit := cmp.Or(tc.inFlight, max(tc.workers, 1)); fl.max > limit {
+			t.Errorf("%+v: got %d concurrent calls, wanted at most %d", tc, fl.max, limit)
+		}
+	}
+
+	// with more servers, the IDs are prefixed and the servers stay in order
+	var fl fakeLibrary
+	c := testCrawler(&fl, crawlConfig{Workers: 4})
+	data, err := c.Crawl(context.Background(), []string{"http://192.0.2.1:8200", "http://192.0.2.2:8200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want2 []string
+	for n := range 2 {
+		for _, id := range want {
+			if s, ok := strings.CutPrefix(id, " "); ok {
+				want2 = append(want2, fmt.Sprintf(" %d:%s", n, s))
+			} else {
+				want2 = append(want2, fmt.Sprintf("%d:%s", n, id))
+			}
+		}
+	}
+	if got := ids(data); !slices.Equal(got, want2) {
+		t.Errorf("two servers: got %q, wanted %q", got, want2)
+	}
+}
+
+func TestCrawlRate(t *testing.T) {
+	var fl fakeLibrary
+	c := testCrawler(&fl, crawlConfig{Workers: 8, Rate: 200})
+	if _, err := c.Crawl(context.Background(), []string{"http://192.0.2.1:8200"}); err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(fl.times, func(a, b time.Time) int { return a.Compare(b) })
+	// the starts are at least 5ms apart, with some slack for the scheduling
+	for i := 1; i < len(fl.times); i++ {
+		if d := fl.times[i].Sub(fl.times[i-1]); d < 4*time.Millisecond {
+			t.Errorf("%d. call %s after the previous", i, d)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+const (
+	didlHeader = `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/" xmlns:dlna="urn:schemas-dlna-org:metadata-1-0/">`
+	didlFooter = `</DIDL-Lite>`
+)
+
+// didlMetadata returns the DIDL-Lite metadata of the item, as expected by SetAVTransportURI.
+func didlMetadata(item dlna.Item) string {
+	var buf strings.Builder
+	buf.WriteString(didlHeader)
+	writeDIDLItem(&buf, item, stripSize(item.Res().URL))
+	buf.WriteString(didlFooter)
+	return buf.String()
+}
+
+// writeDIDLItem writes the item with its main resource, pointing to resURL.
+func writeDIDLItem(buf *strings.Builder, item dlna.Item, resURL string) {
+	esc := func(s string) { xml.EscapeText(buf, []byte(s)) }
+	attr := func(name, value string) {
+		if value != "" {
+			buf.WriteString(" " + name + `="`)
+			esc(value)
+			buf.WriteString(`"`)
+		}
+	}
+	res := item.Res()
+	buf.WriteString(`<item`)
+	attr("id", item.ID)
+	attr("parentID", item.ParentID)
+	buf.WriteString(` restricted="1"><dc:title>`)
+	esc(item.Title)
+	buf.WriteString(`</dc:title><upnp:class>`)
+	esc(item.Class)
+	buf.WriteString(`</upnp:class>`)
+	if item.Creator != "" {
+		buf.WriteString(`<dc:creator>`)
+		esc(item.Creator)
+		buf.WriteString(`</dc:creator>`)
+	}
+	if item.Date != "" {
+		buf.WriteString(`<dc:date>`)
+		esc(item.Date)
+		buf.WriteString(`</dc:date>`)
+	}
+	buf.WriteString(`<res`)
+	attr("protocolInfo", res.ProtocolInfo)
+	attr("size", res.Size)
+	attr("duration", res.Duration)
+	attr("bitrate", res.Bitrate)
+	attr("sampleFrequency", res.SampleFrequency)
+	attr("nrAudioChannels", res.NrAudioChannels)
+	attr("resolution", res.Resolution)
+	buf.WriteString(`>`)
+	esc(resURL)
+	buf.WriteString(`</res></item>`)
+}
+
+// writeDIDLContainer writes the container with the given child count.
+func writeDIDLContainer(buf *strings.Builder, c dlna.Container, childCount int) {
+	esc := func(s string) { xml.EscapeText(buf, []byte(s)) }
+	buf.WriteString(`<container id="`)
+	esc(c.ID)
+	buf.WriteString(`" parentID="`)
+	esc(c.ParentID)
+	buf.WriteString(`" restricted="1" searchable="1" childCount="` + strconv.Itoa(childCount) + `"><dc:title>`)
+	esc(c.Title)
+	buf.WriteString(`</dc:title><upnp:class>`)
+	if c.Class == "" {
+		c.Class = "object.container.storageFolder"
+	}
+	esc(c.Class)
+	buf.WriteString(`</upnp:class></container>`)
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 Tamás Gulácsi.
+
+// Package dlna is a client of DLNA (UPnP AV) MediaServers and MediaRenderers:
+// SSDP discovery, device descriptions, SOAP calls and the ContentDirectory service.
+package dlna
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	MediaServerType      = "urn:schemas-upnp-org:device:MediaServer:1"
+	MediaRendererType    = "urn:schemas-upnp-org:device:MediaRenderer:1"
+	ContentDirectoryType = "urn:schemas-upnp-org:service:ContentDirectory:1"
+
+	// ContentType is the Content-Type of the SOAP requests and responses, and the descriptions.
+	ContentType = "text/xml; charset=utf-8"
+)
+
+// ErrNoService is returned when the device does not have the requested service.
+var ErrNoService = errors.New("no such service")
+
+// Client is a DLNA client. The zero value is usable, and uses http.DefaultClient.
+type Client struct {
+	// HTTPClient is used for all the HTTP calls, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c == nil || c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// Describe fetches and parses the device description at location.
+func (c *Client) Describe(ctx context.Context, location string) (Root, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return Root{}, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return Root{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Root{}, fmt.Errorf("%s: %s", location, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Root{}, err
+	}
+	var root Root
+	if err = xml.Unmarshal(b, &root); err != nil {
+		return Root{}, fmt.Errorf("parse %q: %w", string(b), err)
+	}
+	root.location = location
+	return root, nil
+}
+
+// Arg is an argument of a SOAP action - the order of the arguments matters.
+type Arg struct{ Name, Value string }
+
+// Call calls the action of the service at controlURL, and unmarshals the response into resp.
+//
+// A SOAP fault with UPnPError details is returned as a *UPnPError.
+func (c *Client) Call(ctx context.Context, controlURL, serviceType, action string, args []Arg, resp any) error {
+	var buf strings.Builder
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:`)
+	buf.WriteString(action)
+	buf.WriteString(` xmlns:u="`)
+	xml.EscapeText(&buf, []byte(serviceType))
+	buf.WriteString(`">`)
+	for _, a := range args {
+		buf.WriteString("<" + a.Name + ">")
+		xml.EscapeText(&buf, []byte(a.Value))
+		buf.WriteString("</" + a.Name + ">")
+	}
+	buf.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", controlURL, strings.NewReader(buf.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("SOAPAction", `"`+serviceType+"#"+action+`"`)
+	httpResp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	var envelope struct {
+		Body struct {
+			Inner []byte `xml:",innerxml"`
+			Fault *fault `xml:"Fault"`
+		} `xml:"Body"`
+	}
+	if err = xml.NewDecoder(httpResp.Body).Decode(&envelope); err != nil {
+		if httpResp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s %s: %s", controlURL, action, httpResp.Status)
+		}
+		return fmt.Errorf("%s %s: %w", controlURL, action, err)
+	}
+	if envelope.Body.Fault != nil {
+		return fmt.Errorf("%s: %w", action, envelope.Body.Fault.Err())
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", controlURL, action, httpResp.Status)
+	}
+	if resp == nil {
+		return nil
+	}
+	if err = xml.Unmarshal(envelope.Body.Inner, resp); err != nil {
+		return fmt.Errorf("unmarshal %q: %w", envelope.Body.Inner, err)
+	}
+	return nil
+}
+
+// fault is the SOAP Fault of a failed UPnP action.
+type fault struct {
+	FaultCode   string `xml:"faultcode"`
+	FaultString string `xml:"faultstring"`
+	Detail      struct {
+		UPnPError *struct {
+			ErrorCode        int    `xml:"errorCode"`
+			ErrorDescription string `xml:"errorDescription"`
+		} `xml:"UPnPError"`
+	} `xml:"detail"`
+}
+
+// Err returns the fault as an error - a *UPnPError, if it has UPnPError details.
+func (f *fault) Err() error {
+	ue := f.Detail.UPnPError
+	if ue == nil {
+		return fmt.Errorf("SOAP fault %s: %s", f.FaultCode, f.FaultString)
+	}
+	if ue.ErrorDescription == "" {
+		return NewUPnPError(ue.ErrorCode)
+	}
+	return &UPnPError{Code: ue.ErrorCode, Description: ue.ErrorDescription}
+}
+
+// UPnPError is the error returned by a UPnP action.
+type UPnPError struct {
+	Code        int
+	Description string
+}
+
+// NewUPnPError returns the UPnPError with the code and its standard description.
+func NewUPnPError(code int) *UPnPError {
+	return &UPnPError{Code: code, Description: errorDescriptions[code]}
+}
+
+func (e *UPnPError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// Is reports whether target is a *UPnPError with the same code.
+func (e *UPnPError) Is(target error) bool {
+	t, ok := target.(*UPnPError)
+	return ok && t.Code == e.Code
+}
+
+var errorDescriptions = map[int]string{
+	401: "Invalid Action",
+	402: "Invalid Args",
+	501: "Action Failed",
+	701: "No such object",
+	702: "Invalid CurrentTagValue",
+	708: "Unsupported or invalid search criteria",
+	709: "Unsupported or invalid sort criteria",
+	710: "No such container",
+	711: "Restricted object",
+	714: "No such source resource",
+	718: "Invalid InstanceID",
+	720: "Cannot process the request",
+}
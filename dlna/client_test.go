@@ -0,0 +1,285 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package dlna
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><device><deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+<friendlyName>test</friendlyName><UDN>uuid:test</UDN><serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:ContentDirectory:1</serviceType><controlURL>/ctl</controlURL></service>
+</serviceList></device></root>`
+
+// fakeServer is a MediaServer answering the ContentDirectory calls with control.
+func fakeServer(t *testing.T, control func(action string, args map[string]string) (string, int)) (*Client, Root) {
+	t.Helper()
+	argRE := regexp.MustCompile(`<(\w+)>([^<]*)</\w+>`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(testDesc))
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		_, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPAction"), `"`), "#")
+		args := make(map[string]string)
+		for _, m := range argRE.FindAllStringSubmatch(string(b), -1) {
+			args[m[1]] = m[2]
+		}
+		body, code := control(action, args)
+		w.Header().Set("Content-Type", ContentType)
+		w.WriteHeader(code)
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+			body + `</s:Body></s:Envelope>`))
+	}))
+	t.Cleanup(srv.Close)
+	c := &Client{HTTPClient: srv.Client()}
+	root, err := c.Describe(context.Background(), srv.URL+"/desc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, root
+}
+
+func browseResponse(didl string, returned, total int) string {
+	var buf strings.Builder
+	buf.WriteString(`<u:BrowseResponse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1"><Result>`)
+	xmlEscape(&buf, `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`+
+		didl+`</DIDL-Lite>`)
+	fmt.Fprintf(&buf, `</Result><NumberReturned>%d</NumberReturned><TotalMatches>%d</TotalMatches><UpdateID>1</UpdateID></u:BrowseResponse>`,
+		returned, total)
+	return buf.String()
+}
+
+func xmlEscape(buf *strings.Builder, s string) {
+	strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").WriteString(buf, s)
+}
+
+func TestCallFault(t *testing.T) {
+	for _, tc := range []struct {
+		name, fault string
+		code        int
+		desc        string
+	}{
+		{"upnp", `<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>701</errorCode><errorDescription>No such object</errorDescription></UPnPError>`,
+			701, "No such object"},
+		{"own description", `<UPnPError><errorCode>720</errorCode><errorDescription>busy</errorDescription></UPnPError>`,
+			720, "busy"},
+		{"standard description", `<UPnPError><errorCode>709</errorCode></UPnPError>`,
+			709, "Unsupported or invalid sort criteria"},
+		{"no details", ``, 0, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, root := fakeServer(t, func(string, map[string]string) (string, int) {
+				return `<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+					tc.fault + `</detail></s:Fault>`, http.StatusInternalServerError
+			})
+			_, err := c.Browse(context.Background(), root, BrowseRequest{ObjectID: "0"})
+			if err == nil {
+				t.Fatal("no error")
+			}
+			var ue *UPnPError
+			if tc.code == 0 {
+				if errors.As(err, &ue) {
+					t.Fatalf("got %#v, wanted a plain SOAP fault", ue)
+				}
+				if !strings.Contains(err.Error(), "SOAP fault s:Client") {
+					t.Errorf("got %q", err)
+				}
+				return
+			}
+			if !errors.As(err, &ue) {
+				t.Fatalf("got %#v, wanted *UPnPError", err)
+			}
+			if ue.Code != tc.code || ue.Description != tc.desc {
+				t.Errorf("got %d %q, wanted %d %q", ue.Code, ue.Description, tc.code, tc.desc)
+			}
+			if !errors.Is(err, NewUPnPError(tc.code)) {
+				t.Errorf("%v is not %d", err, tc.code)
+			}
+			if errors.Is(err, NewUPnPError(tc.code+1)) {
+				t.Errorf("%v is %d", err, tc.code+1)
+			}
+		})
+	}
+}
+
+func TestCallHTTPError(t *testing.T) {
+	c := &Client{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	err := c.Call(context.Background(), srv.URL, ContentDirectoryType, "Browse", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, wanted 503", err)
+	}
+}
+
+// pagedServer serves n items of "0", at most max per page, reporting total as TotalMatches (n if negative).
+func pagedServer(t *testing.T, n, max, total int, calls *atomic.Int32) (*Client, Root) {
+	return fakeServer(t, func(action string, args map[string]string) (string, int) {
+		calls.Add(1)
+		start, _ := strconv.Atoi(args["StartingIndex"])
+		count, _ := strconv.Atoi(args["RequestedCount"])
+		if count == 0 || count > max {
+			count = max
+		}
+		var buf strings.Builder
+		var returned int
+		for i := start; i < n && returned < count; i++ {
+			fmt.Fprintf(&buf, `<item id="i%d" parentID="0"><dc:title>%d</dc:title></item>`, i, i)
+			returned++
+		}
+		if total < 0 {
+			total = n
+		}
+		return browseResponse(buf.String(), returned, total), http.StatusOK
+	})
+}
+
+func TestPages(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		n, max, total, count int
+		wantItems, wantCalls int
+	}{
+		{"exact", 5, 2, -1, 2, 5, 3},
+		{"short pages", 5, 2, -1, 3, 5, 3},
+		{"zero total", 5, 2, 0, 2, 5, 4},
+		{"short total", 5, 2, 3, 2, 4, 2},
+		{"empty", 0, 2, -1, 2, 0, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			c, root := pagedServer(t, tc.n, tc.max, tc.total, &calls)
+			var ids []string
+			for res, err := range c.Pages(context.Background(), root, BrowseRequest{ObjectID: "0", RequestedCount: tc.count}) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, it := range res.Items {
+					ids = append(ids, it.ID)
+				}
+			}
+			if len(ids) != tc.wantItems {
+				t.Errorf("got %d items %q, wanted %d", len(ids), ids, tc.wantItems)
+			}
+			for i, id := range ids {
+				if id != "i"+strconv.Itoa(i) {
+					t.Errorf("%d. got %q", i, id)
+				}
+			}
+			if got := int(calls.Load()); got != tc.wantCalls {
+				t.Errorf("got %d calls, wanted %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestPagesError(t *testing.T) {
+	var calls atomic.Int32
+	c, root := fakeServer(t, func(string, map[string]string) (string, int) {
+		calls.Add(1)
+		return `<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError><errorCode>710</errorCode></UPnPError></detail></s:Fault>`,
+			http.StatusInternalServerError
+	})
+	var errs int
+	for _, err := range c.Pages(context.Background(), root, BrowseRequest{ObjectID: "x"}) {
+		if !errors.Is(err, NewUPnPError(710)) {
+			t.Errorf("got %v, wanted 710", err)
+		}
+		errs++
+	}
+	if errs != 1 || calls.Load() != 1 {
+		t.Errorf("got %d errors in %d calls, wanted 1", errs, calls.Load())
+	}
+}
+
+// treeServer serves a tree of containers under "0", two levels deep with two children each, and an item in each.
+func treeServer(t *testing.T) (*Client, Root) {
+	return fakeServer(t, func(action string, args map[string]string) (string, int) {
+		id := args["ObjectID"]
+		var buf strings.Builder
+		var n int
+		if len(id) < 3 {
+			for _, s := range []string{"a", "b"} {
+				fmt.Fprintf(&buf, `<container id="%s%s" parentID="%s"><dc:title>%s%s</dc:title></container>`, id, s, id, id, s)
+				n++
+			}
+		}
+		fmt.Fprintf(&buf, `<item id="%s.item" parentID="%s"><dc:title>item</dc:title></item>`, id, id)
+		n++
+		return browseResponse(buf.String(), n, n), http.StatusOK
+	})
+}
+
+func TestWalk(t *testing.T) {
+	c, root := treeServer(t)
+	var paths []string
+	err := c.Walk(context.Background(), root, "0", func(path []Container, items []Item) error {
+		ids := make([]string, len(path))
+		for i, p := range path {
+			ids[i] = p.ID
+		}
+		if len(items) != 1 {
+			t.Errorf("%q: got %d items", ids, len(items))
+		}
+		paths = append(paths, strings.Join(ids, "/"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"", "0a", "0a/0aa", "0a/0ab", "0b", "0b/0ba", "0b/0bb"}
+	if !slices.Equal(paths, want) {
+		t.Errorf("got %q, wanted %q", paths, want)
+	}
+}
+
+func TestWalkCancel(t *testing.T) {
+	c, root := treeServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls int
+	err := c.Walk(ctx, root, "0", func(path []Container, items []Item) error {
+		calls++
+		if len(path) == 1 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, wanted context.Canceled", err)
+	}
+	if calls != 2 {
+		t.Errorf("fn was called %d times after the cancel, wanted 2", calls)
+	}
+
+	errStop := errors.New("stop")
+	calls = 0
+	err = c.Walk(context.Background(), root, "0", func(path []Container, items []Item) error {
+		if calls++; calls == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || calls != 3 {
+		t.Errorf("got %v after %d calls, wanted %v after 3", err, calls, errStop)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package dlna
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+)
+
+// PageSize is the RequestedCount of the iteration helpers, if the request does not set it.
+const PageSize = 100
+
+// BrowseRequest is the arguments of a ContentDirectory Browse action.
+type BrowseRequest struct {
+	ObjectID string
+	// Filter is the comma-separated list of the requested properties, "*" (all) if empty.
+	Filter string
+	// SortCriteria is the comma-separated list of +property or -property.
+	SortCriteria  string
+	StartingIndex int
+	// RequestedCount is the maximum number of the returned objects, 0 means all.
+	RequestedCount int
+}
+
+// SearchRequest is the arguments of a ContentDirectory Search action.
+type SearchRequest struct {
+	ContainerID    string
+	SearchCriteria string
+	Filter         string
+	SortCriteria   string
+	StartingIndex  int
+	RequestedCount int
+}
+
+// Result is the result of a Browse or Search action.
+type Result struct {
+	DIDLLite
+	NumberReturned int
+	TotalMatches   int
+	UpdateID       int
+}
+
+// contentDirectoryService returns the control URL and the type of the server's ContentDirectory service.
+func contentDirectoryService(server Root) (string, string, error) {
+	const prefix = "urn:schemas-upnp-org:service:ContentDirectory:"
+	controlURL := server.ServiceURL(prefix)
+	if controlURL == "" {
+		return "", "", fmt.Errorf("%s ContentDirectory: %w", server.Location(), ErrNoService)
+	}
+	return controlURL, server.ServiceType(prefix), nil
+}
+
+func (c *Client) contentDirectory(ctx context.Context, server Root, action string, args []Arg) (Result, error) {
+	controlURL, serviceType, err := contentDirectoryService(server)
+	if err != nil {
+		return Result{}, err
+	}
+	var resp struct {
+		Result         string
+		NumberReturned string
+		TotalMatches   string
+		UpdateID       string
+	}
+	if err = c.Call(ctx, controlURL, serviceType, action, args, &resp); err != nil {
+		return Result{}, err
+	}
+	var res Result
+	if err = xml.Unmarshal([]byte(resp.Result), &res.DIDLLite); err != nil {
+		return res, fmt.Errorf("unmarshal %q: %w", resp.Result, err)
+	}
+	res.NumberReturned, _ = strconv.Atoi(strings.TrimSpace(resp.NumberReturned))
+	res.TotalMatches, _ = strconv.Atoi(strings.TrimSpace(resp.TotalMatches))
+	res.UpdateID, _ = strconv.Atoi(strings.TrimSpace(resp.UpdateID))
+	return res, nil
+}
+
+func filter(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
+
+// Browse returns the direct children of req.ObjectID.
+func (c *Client) Browse(ctx context.Context, server Root, req BrowseRequest) (Result, error) {
+	return c.contentDirectory(ctx, server, "Browse", []Arg{
+		{"ObjectID", req.ObjectID},
+		{"BrowseFlag", "BrowseDirectChildren"},
+		{"Filter", filter(req.Filter)},
+		{"StartingIndex", strconv.Itoa(req.StartingIndex)},
+		{"RequestedCount", strconv.Itoa(req.RequestedCount)},
+		{"SortCriteria", req.SortCriteria},
+	})
+}
+
+// BrowseMetadata returns the object itself: a DIDLLite with one container or one item.
+func (c *Client) BrowseMetadata(ctx context.Context, server Root, objectID string) (DIDLLite, error) {
+	res, err := c.contentDirectory(ctx, server, "Browse", []Arg{
+		{"ObjectID", objectID},
+		{"BrowseFlag", "BrowseMetadata"},
+		{"Filter", "*"},
+		{"StartingIndex", "0"},
+		{"RequestedCount", "0"},
+		{"SortCriteria", ""},
+	})
+	return res.DIDLLite, err
+}
+
+// Search returns the objects under req.ContainerID matching req.SearchCriteria.
+func (c *Client) Search(ctx context.Context, server Root, req SearchRequest) (Result, error) {
+	criteria := req.SearchCriteria
+	if criteria == "" {
+		criteria = "*"
+	}
+	return c.contentDirectory(ctx, server, "Search", []Arg{
+		{"ContainerID", req.ContainerID},
+		{"SearchCriteria", criteria},
+		{"Filter", filter(req.Filter)},
+		{"StartingIndex", strconv.Itoa(req.StartingIndex)},
+		{"RequestedCount", strconv.Itoa(req.RequestedCount)},
+		{"SortCriteria", req.SortCriteria},
+	})
+}
+
+// GetSortCapabilities returns the properties the server can sort by.
+func (c *Client) GetSortCapabilities(ctx context.Context, server Root) ([]string, error) {
+	return c.capabilities(ctx, server, "GetSortCapabilities")
+}
+
+// GetSearchCapabilities returns the properties the server can search by.
+func (c *Client) GetSearchCapabilities(ctx context.Context, server Root) ([]string, error) {
+	return c.capabilities(ctx, server, "GetSearchCapabilities")
+}
+
+func (c *Client) capabilities(ctx context.Context, server Root, action string) ([]string, error) {
+	controlURL, serviceType, err := contentDirectoryService(server)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		SortCaps   string
+		SearchCaps string
+	}
+	if err = c.Call(ctx, controlURL, serviceType, action, nil, &resp); err != nil {
+		return nil, err
+	}
+	var caps []string
+	for _, s := range strings.Split(resp.SortCaps+resp.SearchCaps, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			caps = append(caps, s)
+		}
+	}
+	return caps, nil
+}
+
+// Pages browses the children of req.ObjectID page by page, starting at req.StartingIndex,
+// with req.RequestedCount (PageSize if 0) objects per page.
+// The iteration stops after the first error.
+func (c *Client) Pages(ctx context.Context, server Root, req BrowseRequest) iter.Seq2[Result, error] {
+	if req.RequestedCount <= 0 {
+		req.RequestedCount = PageSize
+	}
+	return func(yield func(Result, error) bool) {
+		for {
+			res, err := c.Browse(ctx, server, req)
+			if !yield(res, err) || err != nil || res.NumberReturned == 0 {
+				return
+			}
+			req.StartingIndex += res.NumberReturned
+			if res.TotalMatches != 0 && req.StartingIndex >= res.TotalMatches {
+				return
+			}
+		}
+	}
+}
+
+// Containers iterates over the child containers of objectID.
+func (c *Client) Containers(ctx context.Context, server Root, objectID string) iter.Seq2[Container, error] {
+	return func(yield func(Container, error) bool) {
+		for res, err := range c.Pages(ctx, server, BrowseRequest{ObjectID: objectID}) {
+			if err != nil {
+				yield(Container{}, err)
+				return
+			}
+			for _, cont := range res.Containers {
+				if !yield(cont, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Items iterates over the child items of objectID.
+func (c *Client) Items(ctx context.Context, server Root, objectID string) iter.Seq2[Item, error] {
+	return func(yield func(Item, error) bool) {
+		for res, err := range c.Pages(ctx, server, BrowseRequest{ObjectID: objectID}) {
+			if err != nil {
+				yield(Item{}, err)
+				return
+			}
+			for _, item := range res.Items {
+				if !yield(item, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Walk walks the tree under objectID depth-first, calling fn with each container
+// (the path from objectID to it) and its items. The path is empty for objectID itself.
+func (c *Client) Walk(ctx context.Context, server Root, objectID string, fn func(path []Container, items []Item) error) error {
+	return c.walk(ctx, server, objectID, nil, fn)
+}
+
+func (c *Client) walk(ctx context.Context, server Root, objectID string, path []Container, fn func([]Container, []Item) error) error {
+	var containers []Container
+	var items []Item
+	for res, err := range c.Pages(ctx, server, BrowseRequest{ObjectID: objectID}) {
+		if err != nil {
+			return fmt.Errorf("browse %q: %w", objectID, err)
+		}
+		containers = append(containers, res.Containers...)
+		items = append(items, res.Items...)
+	}
+	if err := fn(path, items); err != nil {
+		return err
+	}
+	for _, cont := range containers {
+		if err := c.walk(ctx, server, cont.ID, append(path[:len(path):len(path)], cont), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
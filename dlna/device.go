@@ -0,0 +1,99 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package dlna
+
+import (
+	"encoding/xml"
+	"net/url"
+	"strings"
+)
+
+// Root was generated 2023-05-13 18:18:47 by https://xml-to-go.github.io/ in Ukraine.
+type Root struct {
+	XMLName     xml.Name `xml:"root" json:"root,omitempty"`
+	location    string   `xml:"-"`
+	URLBase     string   `xml:"URLBase" json:"urlbase,omitempty"`
+	Text        string   `xml:",chardata" json:"text,omitempty"`
+	Xmlns       string   `xml:"xmlns,attr" json:"xmlns,omitempty"`
+	SpecVersion struct {
+		Text  string `xml:",chardata" json:"text,omitempty"`
+		Major string `xml:"major"`
+		Minor string `xml:"minor"`
+	} `xml:"specVersion" json:"specversion,omitempty"`
+	Device struct {
+		Text             string `xml:",chardata" json:"text,omitempty"`
+		DeviceType       string `xml:"deviceType"`
+		FriendlyName     string `xml:"friendlyName"`
+		Manufacturer     string `xml:"manufacturer"`
+		ManufacturerURL  string `xml:"manufacturerURL"`
+		ModelDescription string `xml:"modelDescription"`
+		ModelName        string `xml:"modelName"`
+		ModelNumber      string `xml:"modelNumber"`
+		ModelURL         string `xml:"modelURL"`
+		SerialNumber     string `xml:"serialNumber"`
+		UDN              string `xml:"UDN"`
+		XDLNADOC         struct {
+			Text string `xml:",chardata" json:"text,omitempty"`
+			Dlna string `xml:"dlna,attr" json:"dlna,omitempty"`
+		} `xml:"X_DLNADOC" json:"x_dlnadoc,omitempty"`
+		PresentationURL string `xml:"presentationURL"`
+		IconList        struct {
+			Text string `xml:",chardata" json:"text,omitempty"`
+			Icon []struct {
+				Text     string `xml:",chardata" json:"text,omitempty"`
+				Mimetype string `xml:"mimetype"`
+				Width    string `xml:"width"`
+				Height   string `xml:"height"`
+				Depth    string `xml:"depth"`
+				URL      string `xml:"url"`
+			} `xml:"icon" json:"icon,omitempty"`
+		} `xml:"iconList" json:"iconlist,omitempty"`
+		ServiceList struct {
+			Text    string `xml:",chardata" json:"text,omitempty"`
+			Service []struct {
+				Text        string `xml:",chardata" json:"text,omitempty"`
+				ServiceType string `xml:"serviceType"`
+				ServiceId   string `xml:"serviceId"`
+				ControlURL  string `xml:"controlURL"`
+				EventSubURL string `xml:"eventSubURL"`
+				SCPDURL     string `xml:"SCPDURL"`
+			} `xml:"service" json:"service,omitempty"`
+		} `xml:"serviceList" json:"servicelist,omitempty"`
+	} `xml:"device" json:"device,omitempty"`
+}
+
+// Location returns the URL the description was fetched from.
+func (r Root) Location() string { return r.location }
+
+// ServiceType returns the type of the first service whose type starts with prefix.
+func (r Root) ServiceType(prefix string) string {
+	for _, svc := range r.Device.ServiceList.Service {
+		if strings.HasPrefix(svc.ServiceType, prefix) {
+			return svc.ServiceType
+		}
+	}
+	return ""
+}
+
+// ServiceURL returns the absolute control URL of the first service whose type starts with serviceType.
+func (r Root) ServiceURL(serviceType string) string {
+	for _, svc := range r.Device.ServiceList.Service {
+		if !strings.HasPrefix(svc.ServiceType, serviceType) {
+			continue
+		}
+		base := r.location
+		if r.URLBase != "" {
+			base = r.URLBase
+		}
+		b, err := url.Parse(base)
+		if err != nil {
+			return svc.ControlURL
+		}
+		u, err := b.Parse(svc.ControlURL)
+		if err != nil {
+			return svc.ControlURL
+		}
+		return u.String()
+	}
+	return ""
+}
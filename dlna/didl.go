@@ -0,0 +1,107 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package dlna
+
+import (
+	"encoding/xml"
+	"path"
+	"strings"
+)
+
+// DIDLLite was generated 2023-05-13 18:56:01 by https://xml-to-go.github.io/ in Ukraine.
+type DIDLLite struct {
+	XMLName    xml.Name    `xml:"DIDL-Lite" json:"didl-lite,omitempty"`
+	Text       string      `xml:",chardata" json:"text,omitempty"`
+	Dc         string      `xml:"dc,attr" json:"dc,omitempty"`
+	Upnp       string      `xml:"upnp,attr" json:"upnp,omitempty"`
+	Xmlns      string      `xml:"xmlns,attr" json:"xmlns,omitempty"`
+	Dlna       string      `xml:"dlna,attr" json:"dlna,omitempty"`
+	Containers []Container `xml:"container" json:"container,omitempty"`
+	Items      []Item      `xml:"item" json:"item,omitempty"`
+}
+type Container struct {
+	Text        string `xml:",chardata" json:"text,omitempty"`
+	ID          string `xml:"id,attr" json:"id,omitempty"`
+	ParentID    string `xml:"parentID,attr" json:"parentid,omitempty"`
+	Restricted  string `xml:"restricted,attr" json:"restricted,omitempty"`
+	Searchable  string `xml:"searchable,attr" json:"searchable,omitempty"`
+	ChildCount  string `xml:"childCount,attr" json:"childcount,omitempty"`
+	Title       string `xml:"title"`
+	Class       string `xml:"class"`
+	StorageUsed string `xml:"storageUsed"`
+}
+type Item struct {
+	Text       string `xml:",chardata" json:"text,omitempty"`
+	ID         string `xml:"id,attr" json:"id,omitempty"`
+	ParentID   string `xml:"parentID,attr" json:"parentid,omitempty"`
+	Restricted string `xml:"restricted,attr" json:"restricted,omitempty"`
+	Title      string `xml:"title"`
+	Class      string `xml:"class"`
+	Creator    string `xml:"creator"`
+	Date       string `xml:"date"`
+	Resources  []Res  `xml:"res" json:"res,omitempty"`
+	// MiniDLNA announces sidecar subtitles as sec:CaptionInfoEx, others use sec:CaptionInfo.
+	CaptionInfoEx []Caption `xml:"CaptionInfoEx" json:"captioninfoex,omitempty"`
+	CaptionInfo   []Caption `xml:"CaptionInfo" json:"captioninfo,omitempty"`
+}
+
+// Res returns the main resource of the item: the first non-subtitle one, if there is any.
+func (i Item) Res() Res {
+	for _, r := range i.Resources {
+		if !r.IsSubtitle() {
+			return r
+		}
+	}
+	if len(i.Resources) != 0 {
+		return i.Resources[0]
+	}
+	return Res{}
+}
+
+type Caption struct {
+	URL  string `xml:",chardata" json:"url,omitempty"`
+	Type string `xml:"type,attr" json:"type,omitempty"`
+}
+type Res struct {
+	URL             string `xml:",chardata" json:"url,omitempty"`
+	Size            string `xml:"size,attr" json:"size,omitempty"`
+	Duration        string `xml:"duration,attr" json:"duration,omitempty"`
+	Bitrate         string `xml:"bitrate,attr" json:"bitrate,omitempty"`
+	SampleFrequency string `xml:"sampleFrequency,attr" json:"samplefrequency,omitempty"`
+	NrAudioChannels string `xml:"nrAudioChannels,attr" json:"nraudiochannels,omitempty"`
+	Resolution      string `xml:"resolution,attr" json:"resolution,omitempty"`
+	ProtocolInfo    string `xml:"protocolInfo,attr" json:"protocolinfo,omitempty"`
+}
+
+// MimeType returns the content format part of the protocolInfo ("http-get:*:video/mp4:*").
+func (r Res) MimeType() string {
+	parts := strings.SplitN(r.ProtocolInfo, ":", 4)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[2]
+}
+
+var subtitleMimeTypes = map[string]string{
+	"text/srt":             "srt",
+	"application/x-srt":    "srt",
+	"application/x-subrip": "srt",
+	"smi/caption":          "srt",
+	"text/vtt":             "vtt",
+}
+
+// SubtitleType returns the subtitle type (srt or vtt) of the given mime type or URL, or "" if it's not a subtitle.
+func SubtitleType(mimeType, URL string) string {
+	if typ := subtitleMimeTypes[strings.ToLower(mimeType)]; typ != "" {
+		return typ
+	}
+	if u, _, _ := strings.Cut(URL, "?"); u != "" {
+		switch ext := strings.ToLower(path.Ext(u)); ext {
+		case ".srt", ".vtt":
+			return ext[1:]
+		}
+	}
+	return ""
+}
+
+func (r Res) IsSubtitle() bool { return SubtitleType(r.MimeType(), r.URL) != "" }
@@ -0,0 +1,82 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package dlna
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SSDPAddr is the multicast address of SSDP.
+const SSDPAddr = "239.255.255.250:1900"
+
+// Discover sends an SSDP M-SEARCH for the search target st (a device type, or "ssdp:all"),
+// and returns the LOCATION (description URL) of the devices answering within mx, or until ctx is done.
+func (c *Client) Discover(ctx context.Context, st string, mx time.Duration) ([]string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	addr, err := net.ResolveUDPAddr("udp4", SSDPAddr)
+	if err != nil {
+		return nil, err
+	}
+	secs := int(mx / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	msg := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + SSDPAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: " + strconv.Itoa(secs) + "\r\n" +
+		"ST: " + st + "\r\n\r\n"
+	if _, err = conn.WriteTo([]byte(msg), addr); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(mx + time.Second)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	if err = conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	var locations []string
+	seen := make(map[string]struct{})
+	buf := make([]byte, 8192)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if errors.Is(ctx.Err(), context.Canceled) {
+					return locations, ctx.Err()
+				}
+				return locations, nil
+			}
+			return locations, err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		loc := resp.Header.Get("Location")
+		if loc == "" {
+			continue
+		}
+		if _, ok := seen[loc]; ok {
+			continue
+		}
+		seen[loc] = struct{}{}
+		locations = append(locations, loc)
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package dlna
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDiscoverCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := new(Client).Discover(ctx, MediaRendererType, 10*time.Second)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		t.Skipf("no multicast: %+v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second || !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v after %s, wanted %v at once", err, d, context.Canceled)
+	}
+}
@@ -1,12 +1,15 @@
 module github.com/tgulacsi/webdlna
 
-go 1.23.0
+go 1.24
 
-require github.com/a-h/templ v0.3.960
+require (
+	github.com/a-h/templ v0.3.960
+	github.com/andybalholm/brotli v1.1.0
+	golang.org/x/crypto v0.40.0
+)
 
 require (
 	github.com/a-h/parse v0.0.0-20250122154542-74294addb73e // indirect
-	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/cenkalti/backoff/v4 v4.3.0 // indirect
 	github.com/cli/browser v1.3.0 // indirect
 	github.com/fatih/color v1.16.0 // indirect
@@ -21,6 +24,4 @@ require (
 	golang.org/x/tools v0.35.0 // indirect
 )
 
-tool (
-	github.com/a-h/templ/cmd/templ
-)
+tool github.com/a-h/templ/cmd/templ
@@ -0,0 +1,80 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// serveHealthz reports that the process is alive.
+func (h *handler) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+type upstreamCheck struct {
+	URL       string `json:"url"`
+	Reachable bool   `json:"reachable"`
+	Latency   string `json:"latency,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// serveReadyz reports whether the library has been crawled,
+// and all the upstream servers answer within readyTimeout.
+func (h *handler) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	s := h.conf()
+	l := h.lib()
+	resp := struct {
+		Ready    bool            `json:"ready"`
+		Snapshot *time.Time      `json:"snapshot,omitempty"`
+		Error    string          `json:"error,omitempty"`
+		Servers  []upstreamCheck `json:"servers"`
+	}{Ready: !l.fillTime.IsZero(), Servers: make([]upstreamCheck, len(s.servers))}
+	if resp.Ready {
+		resp.Snapshot = &l.fillTime
+	}
+	if l.err != nil {
+		resp.Error = l.err.Error()
+	}
+
+	for i, u := range s.servers {
+		resp.Servers[i] = upstreamCheck{URL: u, Error: "not checked"}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.readyTimeout)
+	defer cancel()
+	parallel(ctx, len(s.servers), len(s.servers), func(ctx context.Context, i int) {
+		start := time.Now()
+		_, err := getRootDesc(ctx, h.client, s.servers[i])
+		c := upstreamCheck{URL: s.servers[i], Reachable: err == nil, Latency: time.Since(start).String()}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		resp.Servers[i] = c
+	})
+	for _, c := range resp.Servers {
+		resp.Ready = resp.Ready && c.Reachable
+	}
+
+	code := http.StatusOK
+	if !resp.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveStatus shows what is known about the upstream servers.
+func (h *handler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	s := h.conf()
+	statuses := make([]ServerStatus, len(s.servers))
+	for i, u := range s.servers {
+		statuses[i] = h.crawler.Status(u)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(r.Context(), w, printPage("Status", printStatus(statuses, h.lib().fillTime)))
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+// blockingServer is a MediaServer with an empty library, whose Browse answers wait for release.
+// started is closed on the first Browse call.
+func blockingServer(t *testing.T) (url string, started <-chan struct{}, release func()) {
+	t.Helper()
+	start, done := make(chan struct{}), make(chan struct{})
+	var startOnce, doneOnce sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(fakeServerDesc))
+			return
+		}
+		startOnce.Do(func() { close(start) })
+		<-done
+		w.Header().Set("Content-Type", dlna.ContentType)
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+			`<u:BrowseResponse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1"><Result>` +
+			`&lt;DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"&gt;&lt;/DIDL-Lite&gt;` +
+			`</Result><NumberReturned>0</NumberReturned><TotalMatches>0</TotalMatches><UpdateID>1</UpdateID></u:BrowseResponse>` +
+			`</s:Body></s:Envelope>`))
+	}))
+	release = func() { doneOnce.Do(func() { close(done) }) }
+	t.Cleanup(func() { release(); srv.Close() })
+	return srv.URL, start, release
+}
+
+// crawling returns a handler of the server, with a crawl started by a request of the index page;
+// the returned channel is closed when that request is finished.
+func crawling(t *testing.T, url string, started <-chan struct{}) (*handler, <-chan struct{}) {
+	t.Helper()
+	h := newHandler(&dlna.Client{})
+	cfg := defaultConfig()
+	cfg.Servers = []string{url}
+	if err := h.configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the crawl has not started")
+	}
+	return h, finished
+}
+
+// serveWithin serves the request, failing the test if it is not answered within a second.
+func serveWithin(t *testing.T, h http.Handler, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() { defer close(done); h.ServeHTTP(w, httptest.NewRequest("GET", path, nil)) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s is blocked", path)
+	}
+	return w
+}
+
+func TestReadyzDuringCrawl(t *testing.T) {
+	url, started, release := blockingServer(t)
+	h, finished := crawling(t, url, started)
+
+	var resp struct {
+		Ready   bool            `json:"ready"`
+		Servers []upstreamCheck `json:"servers"`
+	}
+	w := serveWithin(t, h, "/readyz")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %+v", w.Body, err)
+	}
+	if w.Code != http.StatusServiceUnavailable || resp.Ready || len(resp.Servers) != 1 || !resp.Servers[0].Reachable {
+		t.Errorf("before the first crawl: got %d %s", w.Code, w.Body)
+	}
+	if w := serveWithin(t, h, "/status"); w.Code != http.StatusOK {
+		t.Errorf("status: got %d", w.Code)
+	}
+
+	release()
+	<-finished
+	if w := serveWithin(t, h, "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("after the crawl: got %d %s", w.Code, w.Body)
+	}
+}
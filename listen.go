@@ -0,0 +1,188 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SocketConfig is the ownership and permissions of the unix sockets.
+type SocketConfig struct {
+	// Mode is the octal permission bits of the sockets, "0660" by default.
+	Mode string `json:"mode,omitempty"`
+	// Group is the name or ID of the group owning the sockets.
+	Group string `json:"group,omitempty"`
+}
+
+// listen returns the listeners of the address, which is
+//   - "unix:/path" (or "unix:///path") for a unix socket,
+//   - "systemd" for all the sockets passed by systemd socket activation, "systemd:name" for the ones named so,
+//   - [host]:port for TCP.
+func listen(addr string, sc SocketConfig) ([]net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		ln, err := listenUnix(strings.TrimPrefix(path, "//"), sc)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	if addr == "systemd" || strings.HasPrefix(addr, "systemd:") {
+		all, err := systemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		name, _ := strings.CutPrefix(addr[len("systemd"):], ":")
+		var lns []net.Listener
+		for _, nl := range all {
+			if name == "" || nl.name == name {
+				lns = append(lns, nl.Listener)
+			}
+		}
+		if len(lns) == 0 {
+			return nil, errors.New("no sockets are passed by systemd")
+		}
+		return lns, nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{ln}, nil
+}
+
+func listenUnix(path string, sc SocketConfig) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("empty unix socket path")
+	}
+	mode := fs.FileMode(0660)
+	if sc.Mode != "" {
+		m, err := strconv.ParseUint(sc.Mode, 8, 32)
+		if err != nil || m&^0777 != 0 {
+			return nil, fmt.Errorf("bad socket mode %q", sc.Mode)
+		}
+		mode = fs.FileMode(m)
+	}
+	gid := -1
+	if sc.Group != "" {
+		g, err := user.LookupGroup(sc.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(sc.Group); err != nil {
+				return nil, err
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, err
+		}
+	}
+	// A stale socket of a previous run would make the listen fail.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	// The socket is created in a private directory, and moved in place only with its final permissions,
+	// so nobody else can connect to it before.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".webdlna-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, mode); err == nil && gid >= 0 {
+		err = os.Chown(tmp, -1, gid)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// unixListener is a unix socket listener moved to addr, which is removed on Close.
+type unixListener struct {
+	*net.UnixListener
+	addr   *net.UnixAddr
+	remove sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr { return l.addr }
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.remove.Do(func() { os.Remove(l.addr.Name) })
+	return err
+}
+
+type namedListener struct {
+	net.Listener
+	name string
+}
+
+// systemdListeners returns the sockets passed by systemd (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES),
+// only once, as the environment is unset to not pass them on.
+var systemdListeners = sync.OnceValues(func() ([]namedListener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_FDS: %w", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, k := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(k)
+	}
+	const listenFDsStart = 3
+	lns := make([]namedListener, 0, n)
+	for i := range n {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %q: %w", name, err)
+		}
+		lns = append(lns, namedListener{Listener: ln, name: name})
+	}
+	return lns, nil
+})
+
+// firstTCPAddr returns the address of the first TCP listener, nil if there's none.
+func firstTCPAddr(lns []net.Listener) *net.TCPAddr {
+	for _, ln := range lns {
+		if a, ok := ln.Addr().(*net.TCPAddr); ok {
+			return a
+		}
+	}
+	return nil
+}
+
+// viaUnixSocket reports whether the request came on a unix socket,
+// which is reachable only by the local proxy (guarded by the socket's permissions).
+func viaUnixSocket(r *http.Request) bool {
+	_, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return ok
+}
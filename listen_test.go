@@ -0,0 +1,137 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "webdlna.sock")
+	lns, err := listen("unix:"+path, SocketConfig{Mode: "0600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := lns[0]
+	if got := ln.Addr().String(); got != path {
+		t.Errorf("got address %q, wanted %q", got, path)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Type() != fs.ModeSocket || fi.Mode().Perm() != 0o600 {
+		t.Errorf("got mode %s", fi.Mode())
+	}
+	// the private directory is gone
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("got %d entries in %s", len(entries), dir)
+	}
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("hi"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err = conn.Read(b); err != nil || string(b) != "hi" {
+		t.Errorf("got %q, %v", b, err)
+	}
+	conn.Close()
+
+	// a listening socket is not taken over
+	if _, err = listen("unix:"+path, SocketConfig{}); err == nil {
+		t.Error("listened on a socket in use")
+	}
+	ln.Close()
+	if _, err = os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("the socket is not removed: %v", err)
+	}
+
+	if _, err = listen("unix:"+path, SocketConfig{Mode: "1777"}); err == nil {
+		t.Error("bad mode accepted")
+	}
+}
+
+// TestSystemdListeners runs itself with two sockets passed as systemd would,
+// and the child prints the listeners it got.
+func TestSystemdListeners(t *testing.T) {
+	if os.Getenv("WEBDLNA_TEST_SYSTEMD") == "1" {
+		// systemd sets LISTEN_PID after the fork
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		for _, addr := range []string{"systemd", "systemd:admin", "systemd:web"} {
+			lns, err := listen(addr, SocketConfig{})
+			if err != nil {
+				fmt.Println(addr, "error", err)
+				continue
+			}
+			for _, ln := range lns {
+				fmt.Println(addr, ln.Addr())
+			}
+		}
+		fmt.Println("env", os.Getenv("LISTEN_PID")+os.Getenv("LISTEN_FDS")+os.Getenv("LISTEN_FDNAMES"))
+		return
+	}
+
+	files := make([]*os.File, 2)
+	addrs := make([]string, 2)
+	for i := range files {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		if files[i], err = ln.(*net.TCPListener).File(); err != nil {
+			t.Fatal(err)
+		}
+		defer files[i].Close()
+		addrs[i] = ln.Addr().String()
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListeners$")
+	cmd.Env = append(os.Environ(), "WEBDLNA_TEST_SYSTEMD=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=web:admin")
+	cmd.ExtraFiles = files
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %+v", out, err)
+	}
+	var got []string
+	sc := bufio.NewScanner(strings.NewReader(string(out)))
+	for sc.Scan() {
+		if line := sc.Text(); strings.HasPrefix(line, "systemd") || strings.HasPrefix(line, "env") {
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		"systemd " + addrs[0], "systemd " + addrs[1],
+		"systemd:admin " + addrs[1],
+		"systemd:web " + addrs[0],
+		"env ",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+func TestSystemdListenersOtherPID(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getppid()))
+	t.Setenv("LISTEN_FDS", "1")
+	if _, err := listen("systemd", SocketConfig{}); err == nil {
+		t.Error("the sockets of another process are used")
+	}
+}
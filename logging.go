@@ -0,0 +1,78 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// logLevel is the level of the logger, changeable by a configuration reload.
+var logLevel = new(slog.LevelVar)
+
+// newLogHandler returns a "text" or "json" handler writing to w,
+// which adds the request and trace IDs of the context to the records.
+func newLogHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "", "text":
+		return ctxHandler{slog.NewTextHandler(w, opts)}, nil
+	case "json":
+		return ctxHandler{slog.NewJSONHandler(w, opts)}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q (text or json)", format)
+	}
+}
+
+// ctxHandler adds the request ID, the user and the trace ID from the context to the records.
+type ctxHandler struct {
+	slog.Handler
+}
+
+func (h ctxHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("requestID", id))
+	}
+	if user := userOf(ctx); user != "" {
+		r.AddAttrs(slog.String("user", user))
+	}
+	if id := traceID(ctx); id != "" {
+		r.AddAttrs(slog.String("traceID", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h ctxHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ctxHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h ctxHandler) WithGroup(name string) slog.Handler {
+	return ctxHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the request ID of the context, "" if it has none.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns the X-Request-ID of the request, if it's sane, a random ID otherwise.
+func newRequestID(header string) string {
+	if len(header) != 0 && len(header) <= 64 && strings.Trim(header, "0123456789abcdefABCDEF-_.:") == "" {
+		return header
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
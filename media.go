@@ -0,0 +1,59 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+func mediaURL(id string) string { return "/media/" + url.PathEscape(id) }
+
+// serveMedia proxies the main resource of the item to the client;
+// with a share link's or the DLNA MediaServer's signed query parameters, without authentication.
+func (h *handler) serveMedia(w http.ResponseWriter, r *http.Request) {
+	var item dlna.Item
+	var err error
+	ctx, id := r.Context(), r.PathValue("id")
+	q := r.URL.Query()
+	if q.Has("share") {
+		if item, err = h.sharedItem(r); err != nil {
+			http.Error(w, err.Error(), shareErrorStatus(err))
+			return
+		}
+	} else if q.Has("dlna") {
+		if !h.shares.VerifyMedia(id, q.Get("dlna")) {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+		if auth := h.conf().auth; auth != nil {
+			ctx = withUser(ctx, auth.DLNAUser())
+		}
+	}
+	if item.ID == "" {
+		if item, err = h.lookupItem(ctx, id); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+	target, err := url.Parse(stripSize(item.Res().URL))
+	if err != nil || target.Host == "" {
+		http.Error(w, item.ID+" has no media", http.StatusNotFound)
+		return
+	}
+	proxy := httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL = target
+			pr.Out.Host = target.Host
+			// webdlna's credentials are not the upstream's business
+			pr.Out.Header.Del("Authorization")
+			pr.Out.Header.Del("Cookie")
+		},
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	proxy.ServeHTTP(sw, r)
+	metrics.proxiedBytes.Add(float64(sw.written), target.Host)
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+func TestServeMediaHeaders(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte("movie"))
+	}))
+	defer upstream.Close()
+	h := newHandler(&dlna.Client{})
+	cfg := defaultConfig()
+	cfg.Auth.Tokens = map[string]string{"secret": "admin"}
+	if err := h.configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	h.library.Store(&library{data: []Folder{{Container: dlna.Container{ID: "64"}, Items: []dlna.Item{
+		{ID: "64$1", ParentID: "64", Title: "Movie.mkv",
+			Resources: []dlna.Res{{URL: upstream.URL + "/movie.mkv", ProtocolInfo: "http-get:*:video/x-matroska:*"}}},
+	}}}, fillTime: time.Now(), expires: time.Now().Add(time.Hour)})
+
+	r := httptest.NewRequest("GET", mediaURL("64$1"), nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=1")
+	r.Header.Set("Range", "bytes=0-")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "movie" {
+		t.Fatalf("got %d %q", w.Code, w.Body)
+	}
+	for _, k := range []string{"Authorization", "Cookie"} {
+		if v := got.Get(k); v != "" {
+			t.Errorf("the upstream got %s: %q", k, v)
+		}
+	}
+	if got.Get("Range") != "bytes=0-" {
+		t.Errorf("the upstream got Range %q", got.Get("Range"))
+	}
+}
@@ -0,0 +1,605 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+const connectionManagerType = "urn:schemas-upnp-org:service:ConnectionManager:1"
+
+// mediaServer re-exports the crawled (and filtered) folders of all the upstream servers
+// as one DLNA MediaServer, with the resources proxied through /media.
+type mediaServer struct {
+	h          *handler
+	name, uuid string
+}
+
+// deviceUUID returns a stable UUID for the seed.
+func deviceUUID(seed string) string {
+	sum := sha1.Sum([]byte(seed))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func (ms *mediaServer) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /dlna/rootDesc.xml", ms.serveDesc)
+	mux.HandleFunc("GET /dlna/ContentDirectory.xml", serveXML(contentDirectorySCPD))
+	mux.HandleFunc("GET /dlna/ConnectionManager.xml", serveXML(connectionManagerSCPD))
+	mux.HandleFunc("POST /dlna/ctl/ContentDirectory", ms.serveContentDirectory)
+	mux.HandleFunc("POST /dlna/ctl/ConnectionManager", ms.serveConnectionManager)
+	mux.HandleFunc("SUBSCRIBE /dlna/evt/{service}", serveSubscribe)
+	mux.HandleFunc("UNSUBSCRIBE /dlna/evt/{service}", func(w http.ResponseWriter, r *http.Request) {})
+}
+
+func serveXML(s string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", dlna.ContentType)
+		io.WriteString(w, s)
+	}
+}
+
+// serveSubscribe accepts the event subscriptions, without sending any events,
+// as some clients refuse to work without a successful subscription.
+func serveSubscribe(w http.ResponseWriter, r *http.Request) {
+	sid := r.Header.Get("SID")
+	if sid == "" {
+		var b [16]byte
+		rand.Read(b[:])
+		sid = fmt.Sprintf("uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+	w.Header().Set("SID", sid)
+	w.Header().Set("TIMEOUT", "Second-1800")
+}
+
+func (ms *mediaServer) serveDesc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", dlna.ContentType)
+	var buf strings.Builder
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><specVersion><major>1</major><minor>0</minor></specVersion>
+<device><deviceType>` + dlna.MediaServerType + `</deviceType><friendlyName>`)
+	xml.EscapeText(&buf, []byte(ms.name))
+	buf.WriteString(`</friendlyName><manufacturer>webdlna</manufacturer><manufacturerURL>https://github.com/tgulacsi/webdlna</manufacturerURL>
+<modelDescription>webdlna MediaServer proxy</modelDescription><modelName>webdlna</modelName><modelNumber>1</modelNumber>
+<UDN>uuid:` + ms.uuid + `</UDN>
+<dlna:X_DLNADOC xmlns:dlna="urn:schemas-dlna-org:device-1-0">DMS-1.50</dlna:X_DLNADOC>
+<presentationURL>/</presentationURL>
+<serviceList>
+<service><serviceType>` + dlna.ContentDirectoryType + `</serviceType><serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId><controlURL>/dlna/ctl/ContentDirectory</controlURL><eventSubURL>/dlna/evt/ContentDirectory</eventSubURL><SCPDURL>/dlna/ContentDirectory.xml</SCPDURL></service>
+<service><serviceType>` + connectionManagerType + `</serviceType><serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId><controlURL>/dlna/ctl/ConnectionManager</controlURL><eventSubURL>/dlna/evt/ConnectionManager</eventSubURL><SCPDURL>/dlna/ConnectionManager.xml</SCPDURL></service>
+</serviceList></device></root>`)
+	io.WriteString(w, buf.String())
+}
+
+var (
+	errInvalidAction = dlna.NewUPnPError(401)
+	errInvalidArgs   = dlna.NewUPnPError(402)
+	errNoSuchObject  = dlna.NewUPnPError(701)
+	errBadSearch     = dlna.NewUPnPError(708)
+)
+
+const searchCaps = "@id,@parentID,dc:title,dc:creator,dc:date,upnp:class,upnp:artist,res@size,res@duration,res@protocolInfo"
+
+func (ms *mediaServer) serveContentDirectory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if auth := ms.h.conf().auth; auth != nil {
+		ctx = withUser(ctx, auth.DLNAUser())
+	}
+	action, args, err := parseSOAPRequest(r)
+	if err != nil {
+		slog.WarnContext(ctx, "ContentDirectory", "action", action, "error", err)
+		writeSOAPFault(w, errInvalidArgs)
+		return
+	}
+	var resp []soapArg
+	switch action {
+	case "Browse":
+		resp, err = ms.browse(ctx, r.Host, args)
+	case "Search":
+		resp, err = ms.search(ctx, r.Host, args)
+	case "GetSearchCapabilities":
+		resp = []soapArg{{"SearchCaps", searchCaps}}
+	case "GetSortCapabilities":
+		resp = []soapArg{{"SortCaps", sortCaps}}
+	case "GetSystemUpdateID":
+		var fillTime time.Time
+		if _, fillTime, err = ms.h.getData(ctx); err == nil {
+			resp = []soapArg{{"Id", updateID(fillTime)}}
+		}
+	default:
+		err = errInvalidAction
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "ContentDirectory", "action", action, "args", args, "error", err)
+		writeSOAPFault(w, err)
+		return
+	}
+	writeSOAPResponse(w, dlna.ContentDirectoryType, action, resp)
+}
+
+func (ms *mediaServer) serveConnectionManager(w http.ResponseWriter, r *http.Request) {
+	action, _, err := parseSOAPRequest(r)
+	if err != nil {
+		writeSOAPFault(w, errInvalidArgs)
+		return
+	}
+	var resp []soapArg
+	switch action {
+	case "GetProtocolInfo":
+		resp = []soapArg{{"Source", "http-get:*:*:*"}, {"Sink", ""}}
+	case "GetCurrentConnectionIDs":
+		resp = []soapArg{{"ConnectionIDs", "0"}}
+	case "GetCurrentConnectionInfo":
+		resp = []soapArg{
+			{"RcsID", "-1"}, {"AVTransportID", "-1"}, {"ProtocolInfo", ""},
+			{"PeerConnectionManager", ""}, {"PeerConnectionID", "-1"},
+			{"Direction", "Output"}, {"Status", "OK"},
+		}
+	default:
+		writeSOAPFault(w, errInvalidAction)
+		return
+	}
+	writeSOAPResponse(w, connectionManagerType, action, resp)
+}
+
+func updateID(t time.Time) string { return strconv.FormatUint(uint64(uint32(t.Unix())), 10) }
+
+// didlObject is a container or an item of the exported tree.
+type didlObject struct {
+	folder     *Folder
+	item       *dlna.Item
+	childCount int
+}
+
+func folderObject(f *Folder) didlObject {
+	return didlObject{folder: f, childCount: len(f.Items)}
+}
+
+func (ms *mediaServer) writeObject(buf *strings.Builder, host string, o didlObject) {
+	if o.item != nil {
+		u := "http://" + host + mediaURL(o.item.ID)
+		// The clients can't authenticate, so the media URLs are signed.
+		if ms.h.conf().auth != nil {
+			u += "?" + ms.h.shares.MediaQuery(o.item.ID)
+		}
+		writeDIDLItem(buf, *o.item, u)
+		return
+	}
+	c := o.folder.Container
+	if c.ID != rootFolder.ID {
+		// the exported tree is flat: all the folders are in the root
+		c.ParentID = rootFolder.ID
+	}
+	writeDIDLContainer(buf, c, o.childCount)
+}
+
+func (ms *mediaServer) result(host string, objects []didlObject, total int, fillTime time.Time) []soapArg {
+	var buf strings.Builder
+	buf.WriteString(didlHeader)
+	for _, o := range objects {
+		ms.writeObject(&buf, host, o)
+	}
+	buf.WriteString(didlFooter)
+	return []soapArg{
+		{"Result", buf.String()},
+		{"NumberReturned", strconv.Itoa(len(objects))},
+		{"TotalMatches", strconv.Itoa(total)},
+		{"UpdateID", updateID(fillTime)},
+	}
+}
+
+// page returns the requested page of the objects.
+func page(objects []didlObject, args map[string]string) ([]didlObject, error) {
+	start, count := 0, 0
+	var err error
+	if s := args["StartingIndex"]; s != "" {
+		if start, err = strconv.Atoi(s); err != nil || start < 0 {
+			return nil, errInvalidArgs
+		}
+	}
+	if s := args["RequestedCount"]; s != "" {
+		if count, err = strconv.Atoi(s); err != nil || count < 0 {
+			return nil, errInvalidArgs
+		}
+	}
+	if start >= len(objects) {
+		return nil, nil
+	}
+	objects = objects[start:]
+	if count > 0 && count < len(objects) {
+		objects = objects[:count]
+	}
+	return objects, nil
+}
+
+var rootFolder = Folder{Container: dlna.Container{ID: "0", ParentID: "-1", Title: "webdlna", Class: "object.container.storageFolder"}}
+
+func (ms *mediaServer) browse(ctx context.Context, host string, args map[string]string) ([]soapArg, error) {
+	data, fillTime, err := ms.h.getData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := args["ObjectID"]
+	var self *didlObject
+	var children []didlObject
+	if id == "0" {
+		for i := range data {
+			if data[i].Err == nil {
+				children = append(children, folderObject(&data[i]))
+			}
+		}
+		self = &didlObject{folder: &rootFolder, childCount: len(children)}
+	} else {
+	Loop:
+		for i := range data {
+			if data[i].ID == id {
+				o := folderObject(&data[i])
+				self = &o
+				keys, err := parseSortCriteria(args["SortCriteria"])
+				if err != nil {
+					return nil, errBadSort
+				}
+				items := ms.h.conf().rules.Items(sortItems(data[i].Items, keys))
+				for j := range items {
+					children = append(children, didlObject{item: &items[j]})
+				}
+				break
+			}
+			for j := range data[i].Items {
+				if data[i].Items[j].ID == id {
+					self = &didlObject{item: &data[i].Items[j]}
+					break Loop
+				}
+			}
+		}
+	}
+	if self == nil {
+		return nil, errNoSuchObject
+	}
+	switch args["BrowseFlag"] {
+	case "BrowseMetadata":
+		return ms.result(host, []didlObject{*self}, 1, fillTime), nil
+	case "BrowseDirectChildren":
+		objects, err := page(children, args)
+		if err != nil {
+			return nil, err
+		}
+		return ms.result(host, objects, len(children), fillTime), nil
+	default:
+		return nil, errInvalidArgs
+	}
+}
+
+func (ms *mediaServer) search(ctx context.Context, host string, args map[string]string) ([]soapArg, error) {
+	match, err := parseSearchCriteria(args["SearchCriteria"])
+	if err != nil {
+		slog.WarnContext(ctx, "parse SearchCriteria", "criteria", args["SearchCriteria"], "error", err)
+		return nil, errBadSearch
+	}
+	keys, err := parseSortCriteria(args["SortCriteria"])
+	if err != nil {
+		return nil, errBadSort
+	}
+	data, fillTime, err := ms.h.getData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := args["ContainerID"]
+	var found bool
+	var items []dlna.Item
+	for i := range data {
+		if id != "0" && data[i].ID != id {
+			continue
+		}
+		found = true
+		for _, it := range data[i].Items {
+			if match(it) {
+				items = append(items, it)
+			}
+		}
+	}
+	if !found && id != "0" {
+		return nil, errNoSuchObject
+	}
+	items = ms.h.conf().rules.Items(sortItems(items, keys))
+	objects := make([]didlObject, len(items))
+	for i := range items {
+		objects[i] = didlObject{item: &items[i]}
+	}
+	total := len(objects)
+	if objects, err = page(objects, args); err != nil {
+		return nil, err
+	}
+	return ms.result(host, objects, total, fillTime), nil
+}
+
+// itemProperty returns the value of the ContentDirectory property of the item.
+func itemProperty(i dlna.Item, prop string) string {
+	switch prop {
+	case "@id":
+		return i.ID
+	case "@parentID":
+		return i.ParentID
+	case "dc:title":
+		return i.Title
+	case "dc:creator", "upnp:artist":
+		return i.Creator
+	case "dc:date":
+		return i.Date
+	case "upnp:class":
+		return i.Class
+	case "res", "res@protocolInfo":
+		return i.Res().ProtocolInfo
+	case "res@size":
+		return i.Res().Size
+	case "res@duration":
+		return i.Res().Duration
+	}
+	return ""
+}
+
+// parseSearchCriteria parses the ContentDirectory SearchCriteria into a matcher function.
+func parseSearchCriteria(s string) (func(dlna.Item) bool, error) {
+	if s = strings.TrimSpace(s); s == "" || s == "*" {
+		return func(dlna.Item) bool { return true }, nil
+	}
+	toks, err := tokenizeSearch(s)
+	if err != nil {
+		return nil, err
+	}
+	p := searchParser{toks: toks}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos].s)
+	}
+	return f, nil
+}
+
+type searchToken struct {
+	s      string
+	quoted bool
+}
+
+func tokenizeSearch(s string) ([]searchToken, error) {
+	var toks []searchToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, searchToken{s: s[i : i+1]})
+			i++
+		case c == '"':
+			var sb strings.Builder
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				sb.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			i++
+			toks = append(toks, searchToken{s: sb.String(), quoted: true})
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\r\n()\"", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, searchToken{s: s[i:j]})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+type searchParser struct {
+	toks []searchToken
+	pos  int
+}
+
+func (p *searchParser) next() (searchToken, bool) {
+	if p.pos >= len(p.toks) {
+		return searchToken{}, false
+	}
+	p.pos++
+	return p.toks[p.pos-1], true
+}
+
+func (p *searchParser) peek(s string) bool {
+	return p.pos < len(p.toks) && !p.toks[p.pos].quoted && strings.EqualFold(p.toks[p.pos].s, s)
+}
+
+func (p *searchParser) or() (func(dlna.Item) bool, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("or") {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(i dlna.Item) bool { return l(i) || right(i) }
+	}
+	return left, nil
+}
+
+func (p *searchParser) and() (func(dlna.Item) bool, error) {
+	left, err := p.rel()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("and") {
+		p.pos++
+		right, err := p.rel()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(i dlna.Item) bool { return l(i) && right(i) }
+	}
+	return left, nil
+}
+
+func (p *searchParser) rel() (func(dlna.Item) bool, error) {
+	if p.peek("(") {
+		p.pos++
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return f, nil
+	}
+	prop, ok1 := p.next()
+	op, ok2 := p.next()
+	val, ok3 := p.next()
+	if !(ok1 && ok2 && ok3) {
+		return nil, errors.New("unexpected end of criteria")
+	}
+	get := func(i dlna.Item) string { return strings.ToLower(itemProperty(i, prop.s)) }
+	v := strings.ToLower(val.s)
+	// compare compares the property to the value like the sorting does (numbers and durations by value),
+	// false for the items without the property.
+	compare := func(ok func(int) bool) func(dlna.Item) bool {
+		return func(i dlna.Item) bool {
+			s := itemProperty(i, prop.s)
+			return s != "" && ok(compareProperty(prop.s, s, val.s))
+		}
+	}
+	switch op.s {
+	case "=":
+		return func(i dlna.Item) bool { return get(i) == v }, nil
+	case "!=":
+		return func(i dlna.Item) bool { return get(i) != v }, nil
+	case "<":
+		return compare(func(c int) bool { return c < 0 }), nil
+	case "<=":
+		return compare(func(c int) bool { return c <= 0 }), nil
+	case ">":
+		return compare(func(c int) bool { return c > 0 }), nil
+	case ">=":
+		return compare(func(c int) bool { return c >= 0 }), nil
+	case "contains":
+		return func(i dlna.Item) bool { return strings.Contains(get(i), v) }, nil
+	case "doesNotContain":
+		return func(i dlna.Item) bool { return !strings.Contains(get(i), v) }, nil
+	case "derivedfrom":
+		return func(i dlna.Item) bool { return strings.HasPrefix(get(i), v) }, nil
+	case "exists":
+		want := v == "true"
+		return func(i dlna.Item) bool { return (get(i) != "") == want }, nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", op.s)
+}
+
+const contentDirectorySCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>Browse</name><argumentList>
+<argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+<argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+<argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+<argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+<argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+<argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+<argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>Search</name><argumentList>
+<argument><name>ContainerID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+<argument><name>SearchCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SearchCriteria</relatedStateVariable></argument>
+<argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+<argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+<argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+<argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+<argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+<argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetSearchCapabilities</name><argumentList>
+<argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetSortCapabilities</name><argumentList>
+<argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetSystemUpdateID</name><argumentList>
+<argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+</argumentList></action>
+</actionList>
+<serviceStateTable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType><allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_SearchCriteria</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+</serviceStateTable></scpd>`
+
+const connectionManagerSCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>GetProtocolInfo</name><argumentList>
+<argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+<argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetCurrentConnectionIDs</name><argumentList>
+<argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument>
+</argumentList></action>
+<action><name>GetCurrentConnectionInfo</name><argumentList>
+<argument><name>ConnectionID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+<argument><name>RcsID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_RcsID</relatedStateVariable></argument>
+<argument><name>AVTransportID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_AVTransportID</relatedStateVariable></argument>
+<argument><name>ProtocolInfo</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ProtocolInfo</relatedStateVariable></argument>
+<argument><name>PeerConnectionManager</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionManager</relatedStateVariable></argument>
+<argument><name>PeerConnectionID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>
+<argument><name>Direction</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Direction</relatedStateVariable></argument>
+<argument><name>Status</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionStatus</relatedStateVariable></argument>
+</argumentList></action>
+</actionList>
+<serviceStateTable>
+<stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionStatus</name><dataType>string</dataType><allowedValueList><allowedValue>OK</allowedValue><allowedValue>ContentFormatMismatch</allowedValue><allowedValue>InsufficientBandwidth</allowedValue><allowedValue>UnreliableChannel</allowedValue><allowedValue>Unknown</allowedValue></allowedValueList></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionManager</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_Direction</name><dataType>string</dataType><allowedValueList><allowedValue>Input</allowedValue><allowedValue>Output</allowedValue></allowedValueList></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ProtocolInfo</name><dataType>string</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionID</name><dataType>i4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_AVTransportID</name><dataType>i4</dataType></stateVariable>
+<stateVariable sendEvents="no"><name>A_ARG_TYPE_RcsID</name><dataType>i4</dataType></stateVariable>
+</serviceStateTable></scpd>`
@@ -0,0 +1,98 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+func TestParseSearchCriteria(t *testing.T) {
+	items := []dlna.Item{
+		{ID: "a", Title: `Say "Hi" \ back`, Creator: "Ann", Class: "object.item.videoItem.movie",
+			Resources: []dlna.Res{{Size: "2000", Duration: "0:10:00.000"}}},
+		{ID: "b", Title: "Big", Class: "object.item.audioItem.musicTrack",
+			Resources: []dlna.Res{{Size: "300", Duration: "1:05:00"}}},
+		{ID: "c", Title: "Notes", Class: "object.item.textItem"},
+	}
+	for _, tc := range []struct {
+		criteria, want string
+	}{
+		{"", "abc"},
+		{"*", "abc"},
+		{`@id = "b"`, "b"},
+		{`dc:title = "big"`, "b"},
+		{`dc:title != "big"`, "ac"},
+
+		// numbers and durations are compared by value, the items without the property don't match
+		{`res@size > 1000`, "a"},
+		{`res@size < "1000"`, "b"},
+		{`res@size >= 300`, "ab"},
+		{`res@size <= 300`, "b"},
+		{`res@duration > "0:9:00"`, "ab"},
+		{`res@duration < "1:00:00"`, "a"},
+		{`res@duration <= "0:10:00"`, "a"},
+		{`dc:title < "c"`, "b"},
+
+		// and binds tighter than or
+		{`dc:title = "Notes" or dc:title = "Big" and upnp:class derivedfrom "object.item.videoItem"`, "c"},
+		{`(dc:title = "Notes" or dc:title = "Big") and upnp:class derivedfrom "object.item.audioItem"`, "b"},
+		{`dc:title = "Big" and upnp:class derivedfrom "object.item.audioItem" or @id = "a"`, "ab"},
+		{`((@id = "a"))`, "a"},
+		{`dc:title = "big" AND upnp:class exists true OR @id = "c"`, "bc"},
+
+		// quoting
+		{`dc:title = "say \"hi\" \\ back"`, "a"},
+		{`dc:title contains "\"hi\""`, "a"},
+		{`dc:title contains "i"`, "ab"},
+		{`dc:title doesNotContain "i"`, "c"},
+		{`dc:title contains "and"`, ""},
+
+		{`res@size exists true`, "ab"},
+		{`res@size exists false`, "c"},
+		{`dc:creator exists true`, "a"},
+		{`upnp:artist exists false`, "bc"},
+		{`upnp:class derivedfrom "object.item"`, "abc"},
+		{`upnp:class derivedfrom "object.item.audioItem"`, "b"},
+		{`upnp:class derivedfrom "object.container"`, ""},
+	} {
+		match, err := parseSearchCriteria(tc.criteria)
+		if err != nil {
+			t.Errorf("%s: %+v", tc.criteria, err)
+			continue
+		}
+		var got []string
+		for _, it := range items {
+			if match(it) {
+				got = append(got, it.ID)
+			}
+		}
+		if !slices.Equal(got, strings.Split(tc.want, "")) && !(len(got) == 0 && tc.want == "") {
+			t.Errorf("%s: got %q, wanted %q", tc.criteria, got, tc.want)
+		}
+	}
+}
+
+func TestParseSearchCriteriaErrors(t *testing.T) {
+	for _, criteria := range []string{
+		`dc:title = "x`,
+		`dc:title = "x\"`,
+		`(dc:title = "x"`,
+		`dc:title = "x")`,
+		`dc:title =`,
+		`dc:title`,
+		`)`,
+		`()`,
+		`dc:title = "x" dc:title`,
+		`dc:title = "x" or`,
+		`dc:title = "x" and and @id = "y"`,
+		`dc:title like "x"`,
+	} {
+		if _, err := parseSearchCriteria(criteria); err == nil {
+			t.Errorf("%s: no error", criteria)
+		}
+	}
+}
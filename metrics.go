@@ -0,0 +1,285 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are the process-wide metrics, exposed on /metrics in the Prometheus text format.
+var metrics = struct {
+	soapCalls, soapErrors, soapDuration *metricVec
+	crawlDuration                       *metricVec
+	cacheHits, cacheMisses              *metricVec
+	httpRequests, httpDuration          *metricVec
+	proxiedBytes                        *metricVec
+}{
+	soapCalls:     newCounter("webdlna_soap_calls_total", "SOAP calls to the upstream servers and renderers.", "upstream", "action"),
+	soapErrors:    newCounter("webdlna_soap_errors_total", "Failed SOAP calls (transport errors and faults).", "upstream", "action"),
+	soapDuration:  newHistogram("webdlna_soap_duration_seconds", "Latency of the SOAP calls.", latencyBuckets, "upstream", "action"),
+	crawlDuration: newHistogram("webdlna_crawl_duration_seconds", "Duration of the crawls of the upstream servers.", crawlBuckets, "upstream"),
+	cacheHits:     newCounter("webdlna_cache_hits_total", "Requests served from the cached library."),
+	cacheMisses:   newCounter("webdlna_cache_misses_total", "Requests that needed a crawl."),
+	httpRequests:  newCounter("webdlna_http_requests_total", "HTTP requests by route and status code.", "route", "code"),
+	httpDuration:  newHistogram("webdlna_http_request_duration_seconds", "Duration of the HTTP requests.", latencyBuckets, "route"),
+	proxiedBytes:  newCounter("webdlna_proxied_bytes_total", "Media bytes proxied from the upstream servers.", "upstream"),
+}
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+	crawlBuckets   = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+)
+
+// metricVec is a counter or a histogram, with labels.
+type metricVec struct {
+	name, help, typ string
+	labels          []string
+	buckets         []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64 // the counter's value or the histogram's sum
+	counts      []uint64
+	count       uint64
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: "counter", labels: labels}
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, typ: "histogram", labels: labels, buckets: buckets}
+}
+
+func (m *metricVec) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s := m.series[key]
+	if s == nil {
+		if m.series == nil {
+			m.series = make(map[string]*series)
+		}
+		s = &series{labelValues: labelValues, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Add adds v to the counter.
+func (m *metricVec) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.get(labelValues).value += v
+	m.mu.Unlock()
+}
+
+// Observe adds v to the histogram.
+func (m *metricVec) Observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	s := m.get(labelValues)
+	s.value += v
+	s.count++
+	for i, le := range m.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	m.mu.Unlock()
+}
+
+// Sum returns the sum of the counter's values.
+func (m *metricVec) Sum() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sum float64
+	for _, s := range m.series {
+		sum += s.value
+	}
+	return sum
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	list := make([]*series, 0, len(m.series))
+	for _, s := range m.series {
+		c := *s
+		c.counts = slices.Clone(s.counts)
+		list = append(list, &c)
+	}
+	m.mu.Unlock()
+	slices.SortFunc(list, func(a, b *series) int { return slices.Compare(a.labelValues, b.labelValues) })
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+	if m.typ != "histogram" {
+		for _, s := range list {
+			writeSample(w, m.name, m.labels, s.labelValues, s.value)
+		}
+		return
+	}
+	labels := append(slices.Clip(m.labels), "le")
+	for _, s := range list {
+		for i, le := range m.buckets {
+			writeSample(w, m.name+"_bucket", labels, append(slices.Clip(s.labelValues), formatFloat(le)), float64(s.counts[i]))
+		}
+		writeSample(w, m.name+"_bucket", labels, append(slices.Clip(s.labelValues), "+Inf"), float64(s.count))
+		writeSample(w, m.name+"_sum", m.labels, s.labelValues, s.value)
+		writeSample(w, m.name+"_count", m.labels, s.labelValues, float64(s.count))
+	}
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, v float64) {
+	io.WriteString(w, name)
+	if len(labels) != 0 {
+		io.WriteString(w, "{")
+		for i, l := range labels {
+			if i != 0 {
+				io.WriteString(w, ",")
+			}
+			io.WriteString(w, l+`="`+labelEscaper.Replace(values[i])+`"`)
+		}
+		io.WriteString(w, "}")
+	}
+	io.WriteString(w, " "+formatFloat(v)+"\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+
+// writeGauge writes a gauge without labels.
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	writeSample(w, name, nil, nil, v)
+}
+
+// metricsTransport counts, logs and traces the SOAP calls going through it.
+type metricsTransport struct {
+	http.RoundTripper
+}
+
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// pass on the ID of the request we're serving, to correlate the upstream's logs
+	if id := requestID(req.Context()); id != "" && req.Header.Get("X-Request-ID") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Request-ID", id)
+	}
+	action := strings.Trim(req.Header.Get("SOAPAction"), `"`)
+	if action == "" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	if _, a, ok := strings.Cut(action, "#"); ok {
+		action = a
+	}
+	ctx, sp := startSpan(req.Context(), "SOAP "+action, spanKindClient,
+		spanAttr{"upstream", req.URL.Host}, spanAttr{"soap.action", action})
+	if tp := traceparent(ctx); tp != "" {
+		req = req.Clone(ctx)
+		req.Header.Set("traceparent", tp)
+	}
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	dur := time.Since(start)
+	metrics.soapCalls.Add(1, req.URL.Host, action)
+	metrics.soapDuration.Observe(dur.Seconds(), req.URL.Host, action)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	if status != http.StatusOK {
+		metrics.soapErrors.Add(1, req.URL.Host, action)
+	}
+	sp.SetAttr("http.response.status_code", status)
+	if err == nil && status != http.StatusOK {
+		sp.End(errors.New(resp.Status))
+	} else {
+		sp.End(err)
+	}
+	slog.DebugContext(req.Context(), "soap", "upstream", req.URL.Host, "action", action, "status", status, "duration", dur, "error", err)
+	return resp, err
+}
+
+// statusWriter records the status code and the number of bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	code    int
+	written int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (h *handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range []*metricVec{
+		metrics.soapCalls, metrics.soapErrors, metrics.soapDuration,
+		metrics.crawlDuration, metrics.cacheHits, metrics.cacheMisses,
+		metrics.httpRequests, metrics.httpDuration, metrics.proxiedBytes,
+	} {
+		m.write(bw)
+	}
+
+	hits, misses := metrics.cacheHits.Sum(), metrics.cacheMisses.Sum()
+	ratio := 0.0
+	if hits+misses != 0 {
+		ratio = hits / (hits + misses)
+	}
+	writeGauge(bw, "webdlna_cache_hit_ratio", "Ratio of the requests served from the cached library.", ratio)
+
+	l := h.lib()
+	fillTime, data := l.fillTime, l.data
+	age := 0.0
+	if !fillTime.IsZero() {
+		age = time.Since(fillTime).Seconds()
+	}
+	writeGauge(bw, "webdlna_cache_age_seconds", "Age of the cached library.", age)
+
+	type key struct{ kind, class string }
+	counts := make(map[key]int)
+	for _, f := range data {
+		counts[key{"container", f.Class}]++
+		for _, it := range f.Items {
+			counts[key{"item", it.Class}]++
+		}
+	}
+	keys := make([]key, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b key) int { return cmp.Or(cmp.Compare(a.kind, b.kind), cmp.Compare(a.class, b.class)) })
+	bw.WriteString("# HELP webdlna_objects Containers and items in the cached library, by class.\n# TYPE webdlna_objects gauge\n")
+	for _, k := range keys {
+		writeSample(bw, "webdlna_objects", []string{"kind", "class"}, []string{k.kind, k.class}, float64(counts[k]))
+	}
+	if err := bw.Flush(); err != nil {
+		slog.WarnContext(r.Context(), "write metrics", "error", err)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsTransportRequestID(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("X-Request-ID"))
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: metricsTransport{http.DefaultTransport}}
+	for _, action := range []string{"", `"urn:schemas-upnp-org:service:ContentDirectory:1#Browse"`} {
+		req, err := http.NewRequestWithContext(withRequestID(context.Background(), "abc-1"), "POST", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != "" {
+			req.Header.Set("SOAPAction", action)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if req.Header.Get("X-Request-ID") != "" {
+			t.Error("the request was modified")
+		}
+	}
+	if len(got) != 2 || got[0] != "abc-1" || got[1] != "abc-1" {
+		t.Errorf("got %q, wanted abc-1 twice", got)
+	}
+}
+
+func TestMetricsDuringCrawl(t *testing.T) {
+	url, started, release := blockingServer(t)
+	h, finished := crawling(t, url, started)
+	w := serveWithin(t, h, "/metrics")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "\nwebdlna_cache_age_seconds 0\n") {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+	release()
+	<-finished
+	if w := serveWithin(t, h, "/metrics"); !strings.Contains(w.Body.String(), "\nwebdlna_cache_age_seconds ") {
+		t.Errorf("after the crawl: got %s", w.Body)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// baseURL is where the client reached webdlna: the scheme, host and path prefix of the links.
+type baseURL struct {
+	Scheme, Host, Prefix string
+}
+
+// requestBase returns the base URL of the request: the configured base path,
+// overridden by the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers of a trusted proxy
+// (or of anybody connecting on a unix socket).
+func (s *settings) requestBase(r *http.Request) baseURL {
+	b := baseURL{Scheme: "http", Host: r.Host, Prefix: s.basePath}
+	if r.TLS != nil {
+		b.Scheme = "https"
+	}
+	if !viaUnixSocket(r) && !s.trustedProxy(r.RemoteAddr) {
+		return b
+	}
+	first := func(key string) string {
+		v, _, _ := strings.Cut(r.Header.Get(key), ",")
+		return strings.TrimSpace(v)
+	}
+	if v := first("X-Forwarded-Proto"); v == "http" || v == "https" {
+		b.Scheme = v
+	}
+	if v := first("X-Forwarded-Host"); v != "" {
+		b.Host = v
+	}
+	if v := first("X-Forwarded-Prefix"); v != "" {
+		b.Prefix = cleanPrefix(v)
+	}
+	return b
+}
+
+func (s *settings) trustedProxy(remoteAddr string) bool {
+	if len(s.trusted) == 0 {
+		return false
+	}
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := ap.Addr().Unmap()
+	for _, p := range s.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses the addresses and CIDRs.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// cleanPrefix returns the path prefix with a leading, but without a trailing slash; "" for the root.
+func cleanPrefix(p string) string {
+	p = strings.TrimRight(p, "/")
+	if p != "" && !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// stripPrefix returns the request with the prefix removed from its path, if it has it
+// (the proxy may or may not strip it).
+func stripPrefix(r *http.Request, prefix string) *http.Request {
+	if prefix == "" {
+		return r
+	}
+	p, ok := strings.CutPrefix(r.URL.Path, prefix)
+	if !ok || (p != "" && p[0] != '/') {
+		return r
+	}
+	rp, _ := strings.CutPrefix(r.URL.RawPath, prefix)
+	if p == "" {
+		p = "/"
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path, r2.URL.RawPath = p, rp
+	return r2
+}
+
+type baseKey struct{}
+
+func withBase(ctx context.Context, b baseURL) context.Context {
+	return context.WithValue(ctx, baseKey{}, b)
+}
+
+// link returns the path prefixed with the base path of the context's request.
+func link(ctx context.Context, path string) string {
+	b, _ := ctx.Value(baseKey{}).(baseURL)
+	return b.Prefix + path
+}
+
+// absLink returns the absolute URL of the path, as the context's request reached us.
+func absLink(ctx context.Context, path string) string {
+	b, _ := ctx.Value(baseKey{}).(baseURL)
+	return b.Scheme + "://" + b.Host + b.Prefix + path
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+func TestRequestBase(t *testing.T) {
+	trusted, err := parsePrefixes([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &settings{basePath: "/webdlna", trusted: trusted}
+	forwarded := http.Header{
+		"X-Forwarded-Proto":  {"https"},
+		"X-Forwarded-Host":   {"media.example.com, proxy.lan"},
+		"X-Forwarded-Prefix": {"/dlna/"},
+	}
+	for _, tc := range []struct {
+		name, remote string
+		header       http.Header
+		tls, unix    bool
+		want         baseURL
+	}{
+		{"direct", "192.0.2.1:1234", nil, false, false, baseURL{"http", "webdlna.lan", "/webdlna"}},
+		{"direct TLS", "192.0.2.1:1234", nil, true, false, baseURL{"https", "webdlna.lan", "/webdlna"}},
+		{"untrusted", "192.0.2.1:1234", forwarded, false, false, baseURL{"http", "webdlna.lan", "/webdlna"}},
+		{"trusted", "10.1.2.3:1234", forwarded, false, false, baseURL{"https", "media.example.com", "/dlna"}},
+		{"trusted IPv6", "[::1]:1234", forwarded, false, false, baseURL{"https", "media.example.com", "/dlna"}},
+		{"trusted IPv4-mapped", "[::ffff:10.1.2.3]:1234", forwarded, false, false, baseURL{"https", "media.example.com", "/dlna"}},
+		{"trusted without headers", "10.1.2.3:1234", nil, false, false, baseURL{"http", "webdlna.lan", "/webdlna"}},
+		{"unix socket", "@", forwarded, false, true, baseURL{"https", "media.example.com", "/dlna"}},
+		{"bad proto", "10.1.2.3:1234", http.Header{"X-Forwarded-Proto": {"gopher"}}, true, false, baseURL{"https", "webdlna.lan", "/webdlna"}},
+		{"root prefix", "10.1.2.3:1234", http.Header{"X-Forwarded-Prefix": {"/"}}, false, false, baseURL{"http", "webdlna.lan", ""}},
+	} {
+		r := httptest.NewRequest("GET", "http://webdlna.lan/", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range tc.header {
+			r.Header[k] = v
+		}
+		if tc.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if tc.unix {
+			r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/webdlna.sock", Net: "unix"}))
+		}
+		if got := s.requestBase(r); got != tc.want {
+			t.Errorf("%s: got %+v, wanted %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, path, want string
+	}{
+		{"", "/folders/1", "/folders/1"},
+		{"/webdlna", "/webdlna/folders/1", "/folders/1"},
+		{"/webdlna", "/webdlna", "/"},
+		{"/webdlna", "/webdlna/", "/"},
+		{"/webdlna", "/folders/1", "/folders/1"},
+		{"/webdlna", "/webdlnax/folders/1", "/webdlnax/folders/1"},
+		{"/webdlna", "/webdlna/media/64%241", "/media/64$1"},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		r2 := stripPrefix(r, tc.prefix)
+		if r2.URL.Path != tc.want {
+			t.Errorf("%q %q: got %q, wanted %q", tc.prefix, tc.path, r2.URL.Path, tc.want)
+		}
+		if r2 != r && r.URL.Path == r2.URL.Path {
+			t.Errorf("%q %q: the original request is modified", tc.prefix, tc.path)
+		}
+	}
+}
+
+func TestLinks(t *testing.T) {
+	ctx := withBase(context.Background(), baseURL{"https", "media.example.com", "/dlna"})
+	if got := link(ctx, "/media/1"); got != "/dlna/media/1" {
+		t.Errorf("link: got %q", got)
+	}
+	if got := absLink(ctx, "/shared/1?sig=x"); got != "https://media.example.com/dlna/shared/1?sig=x" {
+		t.Errorf("absLink: got %q", got)
+	}
+	if got := link(context.Background(), "/media/1"); got != "/media/1" {
+		t.Errorf("link without a base: got %q", got)
+	}
+}
+
+func TestItemPageLinks(t *testing.T) {
+	const upstream = "http://192.0.2.1:8200/MediaItems/1.mkv"
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method == "GET" {
+			return xmlResponse(http.StatusOK, fakeServerDesc), nil
+		}
+		return soapResponse(`<u:BrowseResponse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1"><Result>` +
+			`&lt;DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/"&gt;` +
+			`&lt;item id="64$1" parentID="64"&gt;&lt;dc:title&gt;Movie.mkv&lt;/dc:title&gt;&lt;upnp:class&gt;object.item.videoItem&lt;/upnp:class&gt;` +
+			`&lt;res protocolInfo="http-get:*:video/x-matroska:*"&gt;` + upstream + `&lt;/res&gt;&lt;/item&gt;&lt;/DIDL-Lite&gt;` +
+			`</Result><NumberReturned>1</NumberReturned><TotalMatches>1</TotalMatches><UpdateID>1</UpdateID></u:BrowseResponse>`), nil
+	})
+	h := newHandler(&dlna.Client{HTTPClient: &http.Client{Transport: rt}})
+	cfg := defaultConfig()
+	cfg.Servers = []string{"http://192.0.2.1:8200"}
+	cfg.Proxy.Trusted = []string{"10.0.0.0/8"}
+	if err := h.configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/webdlna/items/64$1", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-Prefix", "/webdlna")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, body)
+	}
+	if !strings.Contains(body, `href="/webdlna/media/64$1" download`) {
+		t.Errorf("no proxied download link in %s", body)
+	}
+	if !strings.Contains(body, upstream) || strings.Contains(body, `href="`+upstream) {
+		t.Errorf("upstream link in %s", body)
+	}
+}
@@ -0,0 +1,659 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+type RepeatMode string
+
+const (
+	RepeatOff = RepeatMode("")
+	RepeatOne = RepeatMode("one")
+	RepeatAll = RepeatMode("all")
+)
+
+// Queue is a named list of item IDs, played in Order.
+type Queue struct {
+	Name string `json:"name"`
+	// Owner is the user who created the queue; a restricted user sees only their own queues.
+	Owner    string     `json:"owner,omitempty"`
+	Items    []string   `json:"items"`
+	Order    []int      `json:"order"`
+	Position int        `json:"position"`
+	Shuffle  bool       `json:"shuffle,omitempty"`
+	Repeat   RepeatMode `json:"repeat,omitempty"`
+	// Renderer is the ID of the renderer the queue is played on.
+	Renderer string `json:"renderer,omitempty"`
+}
+
+// Current returns the index of the current item in Items, or -1.
+func (q Queue) Current() int {
+	if q.Position >= 0 && q.Position < len(q.Order) {
+		return q.Order[q.Position]
+	}
+	return -1
+}
+
+// Next returns the position after pos, obeying the repeat mode.
+func (q Queue) Next(pos int) (int, bool) {
+	if len(q.Order) == 0 {
+		return 0, false
+	}
+	if q.Repeat == RepeatOne {
+		return pos, true
+	}
+	if pos+1 < len(q.Order) {
+		return pos + 1, true
+	}
+	if q.Repeat == RepeatAll {
+		return 0, true
+	}
+	return 0, false
+}
+
+// reorder rebuilds the play order, keeping the item cur (index in Items, or -1) current:
+// shuffled, it stays at Position; in order, Position moves to it.
+func (q *Queue) reorder(cur int) {
+	q.Order = make([]int, len(q.Items))
+	for i := range q.Order {
+		q.Order[i] = i
+	}
+	if q.Shuffle {
+		rand.Shuffle(len(q.Order), func(i, j int) { q.Order[i], q.Order[j] = q.Order[j], q.Order[i] })
+	}
+	if cur < 0 || cur >= len(q.Items) {
+		q.Position = 0
+		return
+	}
+	j := slices.Index(q.Order, cur)
+	if !q.Shuffle {
+		q.Position = j
+		return
+	}
+	if q.Position < 0 || q.Position >= len(q.Order) {
+		q.Position = 0
+	}
+	q.Order[j], q.Order[q.Position] = q.Order[q.Position], q.Order[j]
+}
+
+// find returns the position of the item id, preferring pos, or -1.
+func (q Queue) find(pos int, id string) int {
+	if pos >= 0 && pos < len(q.Order) && q.Items[q.Order[pos]] == id {
+		return pos
+	}
+	return slices.IndexFunc(q.Order, func(i int) bool { return q.Items[i] == id })
+}
+
+// Add appends the item to the queue. With Shuffle, it is put at a random place
+// after the next item, so the current and the next (already handed to the renderer) stay.
+func (q *Queue) Add(id string) {
+	q.Items = append(q.Items, id)
+	at := len(q.Order)
+	if q.Shuffle {
+		lo := min(max(q.Position+2, 0), at)
+		at = lo + rand.IntN(at-lo+1)
+	}
+	q.Order = slices.Insert(q.Order, at, len(q.Items)-1)
+}
+
+// Remove removes the n-th item of Items, keeping the order of the rest.
+// If it was the current item, the one after it becomes the current.
+func (q *Queue) Remove(n int) {
+	if n < 0 || n >= len(q.Items) {
+		return
+	}
+	q.Items = slices.Delete(q.Items, n, n+1)
+	p := slices.Index(q.Order, n)
+	if p < 0 {
+		q.reorder(-1)
+		return
+	}
+	q.Order = slices.Delete(q.Order, p, p+1)
+	for i, j := range q.Order {
+		if j > n {
+			q.Order[i]--
+		}
+	}
+	if p < q.Position {
+		q.Position--
+	}
+}
+
+func (q Queue) clone() Queue {
+	q.Items, q.Order = slices.Clone(q.Items), slices.Clone(q.Order)
+	return q
+}
+
+// queues stores the named play queues, persisted in a JSON file if path is not empty,
+// and plays them on renderers.
+type queues struct {
+	path   string
+	lookup func(ctx context.Context, id string) (dlna.Item, error)
+
+	mu      sync.Mutex
+	byName  map[string]*Queue
+	players map[string]*queuePlayer
+}
+
+type queuePlayer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (qs *queues) Load() error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	qs.byName = make(map[string]*Queue)
+	if qs.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(qs.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var list []*Queue
+	if err = json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("parse %q: %w", qs.path, err)
+	}
+	for _, q := range list {
+		if len(q.Order) != len(q.Items) {
+			q.reorder(-1)
+		}
+		q.Renderer = ""
+		qs.byName[q.Name] = q
+	}
+	return nil
+}
+
+func (qs *queues) saveLocked() error {
+	if qs.path == "" {
+		return nil
+	}
+	list := make([]*Queue, 0, len(qs.byName))
+	for _, q := range qs.byName {
+		list = append(list, q)
+	}
+	slices.SortFunc(list, func(a, b *Queue) int { return strings.Compare(a.Name, b.Name) })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(qs.path), 0750); err != nil {
+		return err
+	}
+	tmp := qs.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, qs.path)
+}
+
+func (qs *queues) Get(name string) (Queue, bool) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q, ok := qs.byName[name]
+	if !ok {
+		return Queue{}, false
+	}
+	return q.clone(), true
+}
+
+// List returns the queues of owner ("" for all) ordered by name.
+func (qs *queues) List(owner string) []Queue {
+	qs.mu.Lock()
+	list := make([]Queue, 0, len(qs.byName))
+	for _, q := range qs.byName {
+		if owner == "" || q.Owner == owner {
+			list = append(list, q.clone())
+		}
+	}
+	qs.mu.Unlock()
+	slices.SortFunc(list, func(a, b Queue) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// Update calls f on the named queue (creating it if it does not exist), and saves the queues.
+func (qs *queues) Update(name string, f func(*Queue) error) error {
+	if name == "" {
+		return errors.New("empty queue name")
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q, ok := qs.byName[name]
+	if !ok {
+		q = &Queue{Name: name}
+	}
+	if err := f(q); err != nil {
+		return err
+	}
+	qs.byName[name] = q
+	return qs.saveLocked()
+}
+
+func (qs *queues) Delete(name string) error {
+	qs.Stop(name)
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	delete(qs.byName, name)
+	return qs.saveLocked()
+}
+
+// Start plays the named queue on the renderer, from its current position, until ctx is canceled;
+// its items are looked up as its owner.
+func (qs *queues) Start(ctx context.Context, name string, rend Renderer) error {
+	qs.Stop(name)
+	ctx, cancel := context.WithCancel(ctx)
+	p := &queuePlayer{cancel: cancel, done: make(chan struct{})}
+	if err := qs.Update(name, func(q *Queue) error {
+		if len(q.Items) == 0 {
+			return fmt.Errorf("queue %q is empty", name)
+		}
+		q.Renderer = rend.ID()
+		if q.Current() < 0 {
+			q.Position = 0
+		}
+		if q.Owner != "" {
+			ctx = withUser(ctx, q.Owner)
+		}
+		return nil
+	}); err != nil {
+		cancel()
+		return err
+	}
+	qs.mu.Lock()
+	if qs.players == nil {
+		qs.players = make(map[string]*queuePlayer)
+	}
+	qs.players[name] = p
+	qs.mu.Unlock()
+	go func() {
+		defer close(p.done)
+		if err := qs.play(ctx, name, rend); err != nil && !errors.Is(err, context.Canceled) {
+			slog.ErrorContext(ctx, "play queue", "queue", name, "renderer", rend.Name(), "error", err)
+		}
+		qs.mu.Lock()
+		if qs.players[name] == p {
+			delete(qs.players, name)
+			if q := qs.byName[name]; q != nil {
+				q.Renderer = ""
+			}
+		}
+		qs.mu.Unlock()
+	}()
+	return nil
+}
+
+// Stop stops playing the named queue, and waits for the player to finish.
+func (qs *queues) Stop(name string) {
+	qs.mu.Lock()
+	p := qs.players[name]
+	delete(qs.players, name)
+	if q := qs.byName[name]; q != nil {
+		q.Renderer = ""
+	}
+	qs.mu.Unlock()
+	if p != nil {
+		p.cancel()
+		<-p.done
+	}
+}
+
+// Close stops all the players, and saves the queues.
+func (qs *queues) Close() error {
+	qs.mu.Lock()
+	names := make([]string, 0, len(qs.players))
+	for name := range qs.players {
+		names = append(names, name)
+	}
+	qs.mu.Unlock()
+	for _, name := range names {
+		qs.Stop(name)
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return qs.saveLocked()
+}
+
+// queuePollInterval is how often the renderer's state is polled while playing a queue.
+var queuePollInterval = 2 * time.Second
+
+// play plays the named queue on the renderer, until the queue ends or ctx is canceled.
+//
+// The queue is re-read on every poll, so the items added or removed meanwhile are obeyed:
+// the player follows the current item by its ID, not by its position.
+// The next item is handed to the renderer with SetNextAVTransportURI for gapless playback;
+// if the renderer does not support it, the next item is started when the current one stops.
+func (qs *queues) play(ctx context.Context, name string, rend Renderer) error {
+	get := func() (Queue, error) {
+		q, ok := qs.Get(name)
+		if !ok {
+			return q, fmt.Errorf("queue %q: %w", name, errNotFound)
+		}
+		return q, nil
+	}
+	item := func(q Queue, pos int) (dlna.Item, error) {
+		if pos < 0 || pos >= len(q.Order) {
+			return dlna.Item{}, fmt.Errorf("queue %q position %d: %w", name, pos, errNotFound)
+		}
+		id := q.Items[q.Order[pos]]
+		it, err := qs.lookup(ctx, id)
+		if err != nil {
+			return it, fmt.Errorf("item %q: %w", id, err)
+		}
+		return it, nil
+	}
+	// setCurrent makes the item id, expected at pos, the current one.
+	setCurrent := func(pos int, id string) error {
+		return qs.Update(name, func(q *Queue) error {
+			if p := q.find(pos, id); p >= 0 {
+				q.Position = p
+			}
+			return nil
+		})
+	}
+
+	var curID, nextID, curURI, nextURI string
+	gapless := true
+	// upcoming returns the position of the item to be played after the current one.
+	upcoming := func(q Queue) (int, bool) {
+		cur := q.Current()
+		if cur < 0 {
+			// the last item has been removed while playing
+			return 0, q.Repeat == RepeatAll && len(q.Order) != 0
+		}
+		if q.Items[cur] == curID {
+			return q.Next(q.Position)
+		}
+		// the current item has been removed, Position points to the one after it
+		return q.Position, true
+	}
+	// start plays the item at pos, skipping the missing items.
+	start := func(pos int) error {
+		for tries := 0; ; tries++ {
+			q, err := get()
+			if err != nil {
+				return err
+			}
+			it, err := item(q, pos)
+			if err == nil {
+				if err = rend.SetAVTransportURI(ctx, it); err != nil {
+					return err
+				}
+				if err = rend.Play(ctx); err != nil {
+					return err
+				}
+				curID, curURI, nextID, nextURI = q.Items[q.Order[pos]], stripSize(it.Res().URL), "", ""
+				return setCurrent(pos, curID)
+			}
+			if !errors.Is(err, errNotFound) && !errors.Is(err, errNoSuchObject) || tries >= len(q.Items) {
+				return err
+			}
+			slog.InfoContext(ctx, "skip", "queue", name, "error", err)
+			var ok bool
+			if pos, ok = q.Next(pos); !ok {
+				return err
+			}
+		}
+	}
+	// handoff hands the upcoming item to the renderer, if it has changed.
+	handoff := func() {
+		if !gapless {
+			return
+		}
+		q, err := get()
+		if err != nil {
+			return
+		}
+		np, ok := upcoming(q)
+		if !ok || q.Items[q.Order[np]] == nextID {
+			return
+		}
+		it, err := item(q, np)
+		if err != nil {
+			return
+		}
+		if err := rend.SetNextAVTransportURI(ctx, it); err != nil {
+			slog.InfoContext(ctx, "SetNextAVTransportURI is not supported", "renderer", rend.Name(), "error", err)
+			gapless = false
+			return
+		}
+		nextID, nextURI = q.Items[q.Order[np]], stripSize(it.Res().URL)
+	}
+
+	q, err := get()
+	if err != nil {
+		return err
+	}
+	if err := start(q.Position); err != nil {
+		return err
+	}
+	handoff()
+
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	var playing bool
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		ti, err := rend.GetTransportInfo(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "GetTransportInfo", "renderer", rend.Name(), "error", err)
+			continue
+		}
+		pi, err := rend.GetPositionInfo(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "GetPositionInfo", "renderer", rend.Name(), "error", err)
+			continue
+		}
+		q, err := get()
+		if err != nil {
+			return err
+		}
+		if nextURI != "" && pi.TrackURI == nextURI && nextURI != curURI {
+			// the renderer moved on to the next item by itself
+			np, _ := upcoming(q)
+			curID, curURI, nextID, nextURI = nextID, nextURI, "", ""
+			if err := setCurrent(np, curID); err != nil {
+				return err
+			}
+			if q, err = get(); err != nil {
+				return err
+			}
+		}
+		if playing && (ti.CurrentTransportState == "STOPPED" || ti.CurrentTransportState == "NO_MEDIA_PRESENT") {
+			np, ok := upcoming(q)
+			if !ok {
+				return nil
+			}
+			if err := start(np); err != nil {
+				return err
+			}
+			handoff()
+			playing = false
+			continue
+		}
+		// the upcoming item may have changed
+		handoff()
+		playing = ti.CurrentTransportState == "PLAYING" || ti.CurrentTransportState == "TRANSITIONING"
+	}
+}
+
+// playContext returns the context for a queue started by the request: canceled on shutdown,
+// but carrying the request's user, request ID and span.
+func (h *handler) playContext(r *http.Request) context.Context {
+	ctx := withRequestID(withUser(h.base, userOf(r.Context())), requestID(r.Context()))
+	if sp, _ := r.Context().Value(spanKey{}).(*span); sp != nil {
+		ctx = context.WithValue(ctx, spanKey{}, sp)
+	}
+	return ctx
+}
+
+func queueURL(name string) string { return "/queues/" + url.PathEscape(name) }
+
+// serveQueues lists the queues of the user (all of them for the unrestricted users).
+func (h *handler) serveQueues(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(r.Context(), w, printPage("Queues", printQueues(h.queues.List(h.owner(r)))))
+}
+
+// queue returns the named queue, if the request's user may manage it.
+func (h *handler) queue(r *http.Request, name string) (Queue, bool) {
+	q, ok := h.queues.Get(name)
+	if owner := h.owner(r); ok && owner != "" && q.Owner != owner {
+		return Queue{}, false
+	}
+	return q, ok
+}
+
+// serveQueueAdd adds the item "id" to the queue "name", creating it (owned by the user) if it does not exist.
+func (h *handler) serveQueueAdd(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name, id := strings.TrimSpace(r.FormValue("name")), r.FormValue("id")
+	if name == "" || id == "" {
+		http.Error(w, "name and id are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.lookupItem(ctx, id); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if _, ok := h.queues.Get(name); ok {
+		if _, ok = h.queue(r, name); !ok {
+			http.Error(w, "queue "+name+" belongs to another user", http.StatusConflict)
+			return
+		}
+	}
+	if err := h.queues.Update(name, func(q *Queue) error {
+		if q.Owner == "" {
+			q.Owner = userOf(ctx)
+		}
+		q.Add(id)
+		return nil
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, link(r.Context(), queueURL(name)), http.StatusSeeOther)
+}
+
+func (h *handler) serveQueue(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q, ok := h.queue(r, r.PathValue("name"))
+	if !ok {
+		http.Error(w, r.PathValue("name")+" Not Found", http.StatusNotFound)
+		return
+	}
+	items := make([]dlna.Item, len(q.Items))
+	for i, id := range q.Items {
+		if it, err := h.queues.lookup(ctx, id); err != nil {
+			slog.WarnContext(ctx, "lookup", "queue", q.Name, "objectID", id, "error", err)
+			items[i] = dlna.Item{ID: id, Title: "(unavailable)"}
+		} else {
+			items[i] = it
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(ctx, w, printPage(q.Name, printQueue(q, items, h.renderers.List())))
+}
+
+// serveQueueAction executes the action (remove, clear, mode, play, stop, delete) on the queue.
+func (h *handler) serveQueueAction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := r.PathValue("name")
+	if _, ok := h.queue(r, name); !ok {
+		http.Error(w, name+" Not Found", http.StatusNotFound)
+		return
+	}
+	var err error
+	switch action := r.PathValue("action"); action {
+	case "remove":
+		var n int
+		if n, err = strconv.Atoi(r.FormValue("n")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = h.queues.Update(name, func(q *Queue) error { q.Remove(n); return nil })
+	case "clear":
+		err = h.queues.Update(name, func(q *Queue) error {
+			q.Items, q.Position = nil, 0
+			q.reorder(-1)
+			return nil
+		})
+	case "mode":
+		repeat := RepeatMode(r.FormValue("repeat"))
+		if repeat != RepeatOff && repeat != RepeatOne && repeat != RepeatAll {
+			http.Error(w, "unknown repeat mode "+string(repeat), http.StatusBadRequest)
+			return
+		}
+		err = h.queues.Update(name, func(q *Queue) error {
+			shuffle := r.FormValue("shuffle") != ""
+			if shuffle != q.Shuffle {
+				q.Shuffle = shuffle
+				q.reorder(q.Current())
+			}
+			q.Repeat = repeat
+			return nil
+		})
+	case "play":
+		var rend Renderer
+		if rend, err = h.renderers.Get(ctx, r.FormValue("renderer")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if r.FormValue("n") != "" {
+			var n int
+			if n, err = strconv.Atoi(r.FormValue("n")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err = h.queues.Update(name, func(q *Queue) error {
+				if p := slices.Index(q.Order, n); p >= 0 {
+					q.Position = p
+				}
+				return nil
+			}); err != nil {
+				break
+			}
+		}
+		err = h.queues.Start(h.playContext(r), name, rend)
+	case "stop":
+		h.queues.Stop(name)
+	case "delete":
+		if err = h.queues.Delete(name); err == nil {
+			http.Redirect(w, r, link(r.Context(), "/queues"), http.StatusSeeOther)
+			return
+		}
+	default:
+		http.Error(w, action+" Not Found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, link(r.Context(), queueURL(name)), http.StatusSeeOther)
+}
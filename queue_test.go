@@ -0,0 +1,314 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+func testQueue(n int) Queue {
+	q := Queue{Name: "q"}
+	for i := range n {
+		q.Items = append(q.Items, fmt.Sprintf("i%d", i))
+	}
+	q.reorder(-1)
+	return q
+}
+
+// isPermutation reports whether order is a permutation of 0..n-1.
+func isPermutation(order []int, n int) bool {
+	s := slices.Sorted(slices.Values(order))
+	for i, j := range s {
+		if i != j {
+			return false
+		}
+	}
+	return len(s) == n
+}
+
+func TestQueueReorder(t *testing.T) {
+	q := testQueue(5)
+	if !slices.Equal(q.Order, []int{0, 1, 2, 3, 4}) || q.Position != 0 {
+		t.Fatalf("got %v at %d", q.Order, q.Position)
+	}
+	for range 20 {
+		q.Shuffle, q.Position = true, 2
+		q.reorder(3)
+		if !isPermutation(q.Order, 5) || q.Position != 2 || q.Current() != 3 {
+			t.Fatalf("got %v at %d, wanted 3 at 2", q.Order, q.Position)
+		}
+	}
+	// back in order, the position follows the current item
+	q.Shuffle = false
+	q.reorder(3)
+	if q.Position != 3 || q.Current() != 3 || !slices.Equal(q.Order, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("got %v at %d, wanted 3 at 3", q.Order, q.Position)
+	}
+	q.Position = 7
+	q.reorder(1)
+	if q.Position != 1 || q.Current() != 1 || !slices.Equal(q.Order, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("got %v at %d, wanted 1 at 1", q.Order, q.Position)
+	}
+	// shuffled, an out of range position restarts
+	q.Shuffle, q.Position = true, 7
+	q.reorder(4)
+	if q.Position != 0 || q.Current() != 4 {
+		t.Errorf("got %v at %d, wanted 4 at 0", q.Order, q.Position)
+	}
+	q.Shuffle = false
+	q.reorder(-1)
+	if q.Position != 0 || !slices.Equal(q.Order, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("got %v at %d", q.Order, q.Position)
+	}
+}
+
+func TestQueueNext(t *testing.T) {
+	for _, tc := range []struct {
+		n      int
+		repeat RepeatMode
+		pos    int
+		want   int
+		ok     bool
+	}{
+		{3, RepeatOff, 0, 1, true},
+		{3, RepeatOff, 2, 0, false},
+		{3, RepeatOne, 1, 1, true},
+		{3, RepeatOne, 2, 2, true},
+		{3, RepeatAll, 1, 2, true},
+		{3, RepeatAll, 2, 0, true},
+		{1, RepeatAll, 0, 0, true},
+		{0, RepeatAll, 0, 0, false},
+		{0, RepeatOne, 0, 0, false},
+	} {
+		q := testQueue(tc.n)
+		q.Repeat = tc.repeat
+		if got, ok := q.Next(tc.pos); got != tc.want || ok != tc.ok {
+			t.Errorf("%d items, repeat %q, after %d: got %d %t, wanted %d %t", tc.n, tc.repeat, tc.pos, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestQueueAdd(t *testing.T) {
+	for range 20 {
+		q := testQueue(4)
+		q.Shuffle, q.Position = true, 1
+		q.reorder(1)
+		before := slices.Clone(q.Order)
+		q.Add("new")
+		if !isPermutation(q.Order, 5) || q.Items[4] != "new" {
+			t.Fatalf("got %v of %q", q.Order, q.Items)
+		}
+		// the current and the next item stay
+		if q.Position != 1 || !slices.Equal(q.Order[:3], before[:3]) {
+			t.Fatalf("got %v at %d, had %v", q.Order, q.Position, before)
+		}
+		if slices.Index(q.Order, 4) < 3 {
+			t.Errorf("new item got in front of the next one: %v", q.Order)
+		}
+	}
+	q := testQueue(2)
+	q.Add("new")
+	if !slices.Equal(q.Order, []int{0, 1, 2}) {
+		t.Errorf("got %v", q.Order)
+	}
+	q = Queue{Shuffle: true}
+	q.Add("first")
+	if !slices.Equal(q.Order, []int{0}) || q.Current() != 0 {
+		t.Errorf("got %v at %d", q.Order, q.Position)
+	}
+}
+
+func TestQueueRemove(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		order     []int
+		pos, n    int
+		wantOrder []int
+		wantPos   int
+		wantCur   string
+	}{
+		{"current", []int{3, 1, 0, 2}, 1, 1, []int{2, 0, 1}, 1, "i0"},
+		{"before", []int{3, 1, 0, 2}, 2, 3, []int{1, 0, 2}, 1, "i0"},
+		{"after", []int{3, 1, 0, 2}, 1, 2, []int{2, 1, 0}, 1, "i1"},
+		{"last current", []int{0, 1, 2, 3}, 3, 3, []int{0, 1, 2}, 3, ""},
+		{"out of range", []int{0, 1, 2, 3}, 0, 4, []int{0, 1, 2, 3}, 0, "i0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := testQueue(4)
+			q.Order, q.Position = tc.order, tc.pos
+			q.Remove(tc.n)
+			if !slices.Equal(q.Order, tc.wantOrder) || q.Position != tc.wantPos {
+				t.Errorf("got %v at %d, wanted %v at %d", q.Order, q.Position, tc.wantOrder, tc.wantPos)
+			}
+			var cur string
+			if c := q.Current(); c >= 0 {
+				cur = q.Items[c]
+			}
+			if cur != tc.wantCur {
+				t.Errorf("got current %q, wanted %q", cur, tc.wantCur)
+			}
+		})
+	}
+}
+
+// playQueue starts playing a queue of n items on a fake renderer.
+func playQueue(t *testing.T, n int, f func(*Queue)) (*queues, *fakeRenderer) {
+	t.Helper()
+	old := queuePollInterval
+	queuePollInterval = 5 * time.Millisecond
+	t.Cleanup(func() { queuePollInterval = old })
+	fr, rend := newFakeRenderer(t)
+	qs := &queues{lookup: func(ctx context.Context, id string) (dlna.Item, error) {
+		if id == "missing" {
+			return dlna.Item{}, errNotFound
+		}
+		return testItem(id, id), nil
+	}}
+	if err := qs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := qs.Update("q", func(q *Queue) error {
+		*q = testQueue(n)
+		if f != nil {
+			f(q)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := qs.Start(context.Background(), "q", rend); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { qs.Close() })
+	return qs, fr
+}
+
+// waitFor waits until cond is true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+// waitPlaying waits until fr plays the item id, with next as the next URI,
+// and the player has seen it.
+func waitPlaying(t *testing.T, fr *fakeRenderer, id, next string) {
+	t.Helper()
+	waitFor(t, id+" playing", fr.playing(id, next))
+	n := fr.polls()
+	waitFor(t, "a poll", func() bool { return fr.polls() > n+1 })
+}
+
+// polls returns the number of GetTransportInfo calls.
+func (fr *fakeRenderer) polls() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	var n int
+	for _, c := range fr.calls {
+		if c.Action == "GetTransportInfo" {
+			n++
+		}
+	}
+	return n
+}
+
+// playing returns a condition that fr plays the item id, with next as the next URI.
+func (fr *fakeRenderer) playing(id, next string) func() bool {
+	return func() bool {
+		fr.mu.Lock()
+		defer fr.mu.Unlock()
+		wantNext := ""
+		if next != "" {
+			wantNext = stripSize(testItem(next, "").Res().URL)
+		}
+		return fr.state == "PLAYING" && fr.uri == stripSize(testItem(id, "").Res().URL) && fr.next == wantNext
+	}
+}
+
+func (qs *queues) position() int {
+	q, _ := qs.Get("q")
+	return q.Position
+}
+
+func (qs *queues) running() bool {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return qs.players["q"] != nil
+}
+
+func TestQueuePlayGapless(t *testing.T) {
+	qs, fr := playQueue(t, 3, nil)
+	waitPlaying(t, fr, "i0", "i1")
+	if q, _ := qs.Get("q"); q.Renderer != "fake-tv" {
+		t.Errorf("got renderer %q", q.Renderer)
+	}
+
+	// the renderer moves on to the next item by itself
+	fr.set(func(fr *fakeRenderer) { fr.uri, fr.next = fr.next, "" })
+	waitPlaying(t, fr, "i1", "i2")
+	if pos := qs.position(); pos != 1 {
+		t.Errorf("got position %d, wanted 1", pos)
+	}
+
+	// the upcoming item is removed: the one after it is handed off
+	if err := qs.Update("q", func(q *Queue) error { q.Add("i3"); q.Remove(2); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	waitPlaying(t, fr, "i1", "i3")
+
+	fr.set(func(fr *fakeRenderer) { fr.uri, fr.next = fr.next, "" })
+	waitPlaying(t, fr, "i3", "")
+	fr.set(func(fr *fakeRenderer) { fr.state = "STOPPED" })
+	waitFor(t, "the end", func() bool { return !qs.running() })
+	if q, _ := qs.Get("q"); q.Renderer != "" || q.Position != 2 {
+		t.Errorf("got %q at %d", q.Renderer, q.Position)
+	}
+}
+
+func TestQueuePlayStopped(t *testing.T) {
+	qs, fr := playQueue(t, 4, func(q *Queue) {
+		q.Items[1] = "missing"
+		q.Repeat = RepeatAll
+	})
+	fr.set(func(fr *fakeRenderer) { fr.noNext = true })
+	waitPlaying(t, fr, "i0", "")
+
+	// the missing item is skipped
+	fr.set(func(fr *fakeRenderer) { fr.state = "STOPPED" })
+	waitPlaying(t, fr, "i2", "")
+	if pos := qs.position(); pos != 2 {
+		t.Errorf("got position %d, wanted 2", pos)
+	}
+
+	// the current item is removed: the one after it is played
+	if err := qs.Update("q", func(q *Queue) error { q.Remove(2); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	fr.set(func(fr *fakeRenderer) { fr.state = "STOPPED" })
+	waitPlaying(t, fr, "i3", "")
+
+	// repeat all starts over
+	fr.set(func(fr *fakeRenderer) { fr.state = "STOPPED" })
+	waitPlaying(t, fr, "i0", "")
+	if pos := qs.position(); pos != 0 {
+		t.Errorf("got position %d, wanted 0", pos)
+	}
+
+	qs.Stop("q")
+	if qs.running() {
+		t.Error("still running after Stop")
+	}
+	if got := fr.actions(); slices.Contains(got, "Stop") {
+		t.Errorf("got %q, the queue player should not stop the renderer", got)
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+const (
+	avTransportType      = "urn:schemas-upnp-org:service:AVTransport:"
+	renderingControlType = "urn:schemas-upnp-org:service:RenderingControl:"
+)
+
+// Renderer is a DLNA MediaRenderer with an AVTransport service,
+// and an optional RenderingControl service.
+type Renderer struct {
+	dlna.Root
+	client                                 *dlna.Client
+	avTransport, avTransportType           string
+	renderingControl, renderingControlType string
+}
+
+func newRenderer(client *dlna.Client, root dlna.Root) (Renderer, error) {
+	r := Renderer{
+		Root:                 root,
+		client:               client,
+		avTransport:          root.ServiceURL(avTransportType),
+		avTransportType:      root.ServiceType(avTransportType),
+		renderingControl:     root.ServiceURL(renderingControlType),
+		renderingControlType: root.ServiceType(renderingControlType),
+	}
+	if r.avTransport == "" {
+		return r, fmt.Errorf("%s AVTransport: %w", root.Location(), dlna.ErrNoService)
+	}
+	return r, nil
+}
+
+func (r Renderer) ID() string   { return strings.TrimPrefix(r.Device.UDN, "uuid:") }
+func (r Renderer) Name() string { return r.Device.FriendlyName }
+
+func (r Renderer) transport(ctx context.Context, action string, args []dlna.Arg, resp any) error {
+	return r.client.Call(ctx, r.avTransport, r.avTransportType, action,
+		append([]dlna.Arg{{Name: "InstanceID", Value: "0"}}, args...), resp)
+}
+
+// SetAVTransportURI sets the item as the current media of the renderer.
+func (r Renderer) SetAVTransportURI(ctx context.Context, item dlna.Item) error {
+	return r.transport(ctx, "SetAVTransportURI", []dlna.Arg{
+		{Name: "CurrentURI", Value: stripSize(item.Res().URL)},
+		{Name: "CurrentURIMetaData", Value: didlMetadata(item)},
+	}, nil)
+}
+
+// SetNextAVTransportURI sets the item to be played after the current one.
+func (r Renderer) SetNextAVTransportURI(ctx context.Context, item dlna.Item) error {
+	return r.transport(ctx, "SetNextAVTransportURI", []dlna.Arg{
+		{Name: "NextURI", Value: stripSize(item.Res().URL)},
+		{Name: "NextURIMetaData", Value: didlMetadata(item)},
+	}, nil)
+}
+
+func (r Renderer) Play(ctx context.Context) error {
+	return r.transport(ctx, "Play", []dlna.Arg{{Name: "Speed", Value: "1"}}, nil)
+}
+func (r Renderer) Pause(ctx context.Context) error { return r.transport(ctx, "Pause", nil, nil) }
+func (r Renderer) Stop(ctx context.Context) error  { return r.transport(ctx, "Stop", nil, nil) }
+
+var relTimeRE = regexp.MustCompile(`^\d+:\d{2}:\d{2}(\.\d+)?$`)
+
+// Seek seeks to the target relative time (H+:MM:SS).
+func (r Renderer) Seek(ctx context.Context, target string) error {
+	if !relTimeRE.MatchString(target) {
+		return fmt.Errorf("%q: %w", target, errBadTime)
+	}
+	return r.transport(ctx, "Seek", []dlna.Arg{{Name: "Unit", Value: "REL_TIME"}, {Name: "Target", Value: target}}, nil)
+}
+
+var errBadTime = errors.New("time must be in H:MM:SS format")
+
+type PositionInfo struct {
+	Track         string
+	TrackDuration string
+	TrackMetaData string
+	TrackURI      string
+	RelTime       string
+	AbsTime       string
+}
+
+func (r Renderer) GetPositionInfo(ctx context.Context) (PositionInfo, error) {
+	var pi PositionInfo
+	err := r.transport(ctx, "GetPositionInfo", nil, &pi)
+	return pi, err
+}
+
+type TransportInfo struct {
+	CurrentTransportState  string
+	CurrentTransportStatus string
+	CurrentSpeed           string
+}
+
+func (r Renderer) GetTransportInfo(ctx context.Context) (TransportInfo, error) {
+	var ti TransportInfo
+	err := r.transport(ctx, "GetTransportInfo", nil, &ti)
+	return ti, err
+}
+
+// HasRenderingControl reports whether the renderer has a RenderingControl service.
+func (r Renderer) HasRenderingControl() bool { return r.renderingControl != "" }
+
+func (r Renderer) rendering(ctx context.Context, action string, args []dlna.Arg, resp any) error {
+	if r.renderingControl == "" {
+		return fmt.Errorf("%s: no RenderingControl service: %w", r.Name(), errNotFound)
+	}
+	return r.client.Call(ctx, r.renderingControl, r.renderingControlType, action,
+		append([]dlna.Arg{{Name: "InstanceID", Value: "0"}, {Name: "Channel", Value: "Master"}}, args...), resp)
+}
+
+// Volume is the volume (0-100) and mute state of a renderer.
+type Volume struct {
+	Volume int  `json:"volume"`
+	Mute   bool `json:"mute"`
+}
+
+// GetVolume returns the volume and the mute state of the renderer.
+func (r Renderer) GetVolume(ctx context.Context) (Volume, error) {
+	var vol struct{ CurrentVolume int }
+	if err := r.rendering(ctx, "GetVolume", nil, &vol); err != nil {
+		return Volume{}, err
+	}
+	var mute struct{ CurrentMute string }
+	if err := r.rendering(ctx, "GetMute", nil, &mute); err != nil {
+		return Volume{}, err
+	}
+	return Volume{Volume: vol.CurrentVolume, Mute: mute.CurrentMute == "1" || mute.CurrentMute == "true"}, nil
+}
+
+func (r Renderer) SetVolume(ctx context.Context, volume int) error {
+	if volume < 0 || volume > 100 {
+		return fmt.Errorf("volume %d: %w", volume, errBadVolume)
+	}
+	return r.rendering(ctx, "SetVolume", []dlna.Arg{{Name: "DesiredVolume", Value: strconv.Itoa(volume)}}, nil)
+}
+
+func (r Renderer) SetMute(ctx context.Context, mute bool) error {
+	desired := "0"
+	if mute {
+		desired = "1"
+	}
+	return r.rendering(ctx, "SetMute", []dlna.Arg{{Name: "DesiredMute", Value: desired}}, nil)
+}
+
+var errBadVolume = errors.New("volume must be between 0 and 100")
+
+// renderers is the registry of the known MediaRenderers:
+// the statically configured ones and the ones found by SSDP.
+type renderers struct {
+	client *dlna.Client
+
+	mu        sync.Mutex
+	static    []string
+	discover  bool
+	byID      map[string]Renderer
+	refreshed time.Time
+}
+
+// Configure sets the static renderers, and whether to search for renderers with SSDP.
+func (rs *renderers) Configure(static []string, discover bool) {
+	rs.mu.Lock()
+	rs.static, rs.discover, rs.refreshed = static, discover, time.Time{}
+	rs.mu.Unlock()
+}
+
+// Refresh searches for renderers with SSDP (if enabled), and describes the static ones.
+// The returned error is the SSDP search's, the failing descriptions are only logged.
+func (rs *renderers) Refresh(ctx context.Context) error {
+	rs.mu.Lock()
+	static, discover := rs.static, rs.discover
+	rs.mu.Unlock()
+	var locations []string
+	var err error
+	if discover {
+		locations, err = rs.client.Discover(ctx, dlna.MediaRendererType, 2*time.Second)
+	}
+	byID := make(map[string]Renderer, len(locations)+len(static))
+	for _, loc := range slices.Concat(static, locations) {
+		root, err := rs.client.Describe(ctx, loc)
+		if err != nil {
+			slog.WarnContext(ctx, "describe renderer", "location", loc, "error", err)
+			continue
+		}
+		r, err := newRenderer(rs.client, root)
+		if err != nil {
+			slog.WarnContext(ctx, "describe renderer", "location", loc, "error", err)
+			continue
+		}
+		byID[r.ID()] = r
+	}
+	rs.mu.Lock()
+	rs.byID, rs.refreshed = byID, time.Now()
+	rs.mu.Unlock()
+	return err
+}
+
+// List returns the known renderers, ordered by name.
+func (rs *renderers) List() []Renderer {
+	rs.mu.Lock()
+	list := make([]Renderer, 0, len(rs.byID))
+	for _, r := range rs.byID {
+		list = append(list, r)
+	}
+	rs.mu.Unlock()
+	slices.SortFunc(list, func(a, b Renderer) int { return strings.Compare(a.Name(), b.Name()) })
+	return list
+}
+
+// Get returns the renderer with the given ID, refreshing the list if it's unknown.
+func (rs *renderers) Get(ctx context.Context, id string) (Renderer, error) {
+	rs.mu.Lock()
+	r, ok := rs.byID[id]
+	stale := time.Since(rs.refreshed) > time.Minute
+	rs.mu.Unlock()
+	if ok {
+		return r, nil
+	}
+	if stale {
+		rs.Refresh(ctx)
+		rs.mu.Lock()
+		r, ok = rs.byID[id]
+		rs.mu.Unlock()
+		if ok {
+			return r, nil
+		}
+	}
+	return r, fmt.Errorf("renderer %q: %w", id, errNotFound)
+}
+
+var errNotFound = errors.New("not found")
+
+func rendererURL(id string) string { return "/renderers/" + url.PathEscape(id) }
+
+func (h *handler) serveRenderers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if err := h.renderers.Refresh(ctx); err != nil {
+		slog.WarnContext(ctx, "refresh renderers", "error", err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(ctx, w, printPage("Renderers", printRenderers(h.renderers.List())))
+}
+
+func (h *handler) serveRemote(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rend, err := h.renderers.Get(ctx, r.PathValue("renderer"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	ti, err := rend.GetTransportInfo(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	pi, err := rend.GetPositionInfo(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	var vol *Volume
+	if rend.HasRenderingControl() {
+		if v, err := rend.GetVolume(ctx); err != nil {
+			slog.WarnContext(ctx, "get volume", "renderer", rend.Name(), "error", err)
+		} else {
+			vol = &v
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(ctx, w, printPage(rend.Name(), printRemote(rend, ti, pi, vol)))
+}
+
+// serveRendererAction executes the action (play, pause, stop, seek) on the renderer.
+// Play with an "id" form value starts playing that item.
+func (h *handler) serveRendererAction(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rend, err := h.renderers.Get(ctx, r.PathValue("renderer"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	switch action := r.PathValue("action"); action {
+	case "play":
+		if id := r.FormValue("id"); id != "" {
+			item, err := h.lookupItem(ctx, id)
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			if err = rend.SetAVTransportURI(ctx, item); err != nil {
+				break
+			}
+		}
+		err = rend.Play(ctx)
+	case "pause":
+		err = rend.Pause(ctx)
+	case "stop":
+		err = rend.Stop(ctx)
+	case "seek":
+		if err = rend.Seek(ctx, r.FormValue("target")); errors.Is(err, errBadTime) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "volume":
+		var volume int
+		if volume, err = strconv.Atoi(r.FormValue("volume")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = rend.SetVolume(ctx, volume); errors.Is(err, errBadVolume) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err == nil {
+			err = rend.SetMute(ctx, r.FormValue("mute") != "")
+		}
+	default:
+		http.Error(w, action+" Not Found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	http.Redirect(w, r, link(r.Context(), rendererURL(rend.ID())), http.StatusSeeOther)
+}
+
+// serveVolume is the JSON API of the renderer's volume:
+// GET returns the Volume, PUT sets the given fields of it.
+func (h *handler) serveVolume(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rend, err := h.renderers.Get(ctx, r.PathValue("renderer"))
+	if err != nil {
+		writeJSONError(w, err, http.StatusNotFound)
+		return
+	}
+	if !rend.HasRenderingControl() {
+		writeJSONError(w, fmt.Errorf("%s: no RenderingControl service", rend.Name()), http.StatusNotFound)
+		return
+	}
+	if r.Method == "PUT" {
+		var req struct {
+			Volume *int  `json:"volume"`
+			Mute   *bool `json:"mute"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		if req.Volume != nil {
+			if err := rend.SetVolume(ctx, *req.Volume); err != nil {
+				code := errorStatus(err)
+				if errors.Is(err, errBadVolume) {
+					code = http.StatusBadRequest
+				}
+				writeJSONError(w, err, code)
+				return
+			}
+		}
+		if req.Mute != nil {
+			if err := rend.SetMute(ctx, *req.Mute); err != nil {
+				writeJSONError(w, err, errorStatus(err))
+				return
+			}
+		}
+	}
+	vol, err := rend.GetVolume(ctx)
+	if err != nil {
+		writeJSONError(w, err, errorStatus(err))
+		return
+	}
+	writeJSON(w, vol)
+}
@@ -0,0 +1,321 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+const fakeRendererDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><device><deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+<friendlyName>Fake TV</friendlyName><UDN>uuid:fake-tv</UDN><serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType><controlURL>/AVTransport</controlURL></service>
+<service><serviceType>urn:schemas-upnp-org:service:RenderingControl:1</serviceType><controlURL>/RenderingControl</controlURL></service>
+</serviceList></device></root>`
+
+// fakeRenderer is an AVTransport and RenderingControl service, recording the calls.
+type fakeRenderer struct {
+	mu    sync.Mutex
+	calls []fakeCall
+
+	state, uri, next, rel string
+	volume                int
+	mute                  bool
+	// noNext makes SetNextAVTransportURI fail with Invalid Action.
+	noNext bool
+}
+
+type fakeCall struct {
+	Service, Action string
+	Args            map[string]string
+}
+
+// newFakeRenderer starts a fake renderer, and returns the Renderer connected to it.
+func newFakeRenderer(t *testing.T) (*fakeRenderer, Renderer) {
+	t.Helper()
+	fr := &fakeRenderer{state: "NO_MEDIA_PRESENT", rel: "0:00:00", volume: 20}
+	srv := httptest.NewServer(fr)
+	t.Cleanup(srv.Close)
+	client := &dlna.Client{HTTPClient: srv.Client()}
+	root, err := client.Describe(context.Background(), srv.URL+"/desc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRenderer(client, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fr, r
+}
+
+func (fr *fakeRenderer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		w.Write([]byte(fakeRendererDesc))
+		return
+	}
+	var envelope struct {
+		Body struct {
+			Action struct {
+				XMLName xml.Name
+				Args    []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		}
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&envelope); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a := envelope.Body.Action
+	call := fakeCall{Service: strings.TrimPrefix(r.URL.Path, "/"), Action: a.XMLName.Local, Args: make(map[string]string)}
+	for _, arg := range a.Args {
+		call.Args[arg.XMLName.Local] = arg.Value
+	}
+	serviceType := "urn:schemas-upnp-org:service:" + call.Service + ":1"
+	if soapAction := `"` + serviceType + "#" + call.Action + `"`; r.Header.Get("SOAPAction") != soapAction {
+		http.Error(w, "SOAPAction is "+r.Header.Get("SOAPAction")+", wanted "+soapAction, http.StatusBadRequest)
+		return
+	}
+
+	fr.mu.Lock()
+	fr.calls = append(fr.calls, call)
+	var resp string
+	var fault int
+	switch call.Action {
+	case "SetAVTransportURI":
+		fr.uri, fr.next, fr.state, fr.rel = call.Args["CurrentURI"], "", "STOPPED", "0:00:00"
+	case "SetNextAVTransportURI":
+		if fr.noNext {
+			fault = 401
+		} else {
+			fr.next = call.Args["NextURI"]
+		}
+	case "Play":
+		fr.state = "PLAYING"
+	case "Pause":
+		fr.state = "PAUSED_PLAYBACK"
+	case "Stop":
+		fr.state = "STOPPED"
+	case "Seek":
+		fr.rel = call.Args["Target"]
+	case "GetTransportInfo":
+		resp = "<CurrentTransportState>" + fr.state + "</CurrentTransportState><CurrentTransportStatus>OK</CurrentTransportStatus><CurrentSpeed>1</CurrentSpeed>"
+	case "GetPositionInfo":
+		var buf strings.Builder
+		xml.EscapeText(&buf, []byte(fr.uri))
+		resp = "<Track>1</Track><TrackDuration>0:01:30.500</TrackDuration><TrackMetaData></TrackMetaData><TrackURI>" +
+			buf.String() + "</TrackURI><RelTime>" + fr.rel + "</RelTime><AbsTime>NOT_IMPLEMENTED</AbsTime>"
+	case "GetVolume":
+		resp = "<CurrentVolume>" + strconv.Itoa(fr.volume) + "</CurrentVolume>"
+	case "SetVolume":
+		fr.volume, _ = strconv.Atoi(call.Args["DesiredVolume"])
+	case "GetMute":
+		resp = "<CurrentMute>" + map[bool]string{false: "0", true: "1"}[fr.mute] + "</CurrentMute>"
+	case "SetMute":
+		fr.mute = call.Args["DesiredMute"] == "1"
+	default:
+		fault = 401
+	}
+	fr.mu.Unlock()
+
+	w.Header().Set("Content-Type", dlna.ContentType)
+	if fault != 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, fault)
+		return
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`,
+		call.Action, serviceType, resp, call.Action)
+}
+
+// set changes the state of the renderer under its lock.
+func (fr *fakeRenderer) set(f func(*fakeRenderer)) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	f(fr)
+}
+
+// actions returns the actions called so far, except the Get* polls.
+func (fr *fakeRenderer) actions() []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	var actions []string
+	for _, c := range fr.calls {
+		if !strings.HasPrefix(c.Action, "Get") {
+			actions = append(actions, c.Action)
+		}
+	}
+	return actions
+}
+
+func (fr *fakeRenderer) lastCall() fakeCall {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if len(fr.calls) == 0 {
+		return fakeCall{}
+	}
+	return fr.calls[len(fr.calls)-1]
+}
+
+func testItem(id, title string) dlna.Item {
+	return dlna.Item{
+		ID: id, ParentID: "64", Title: title, Class: "object.item.videoItem",
+		Resources: []dlna.Res{{
+			URL:          "http://192.0.2.1:8200/MediaItems/" + id + ".mkv?width=160",
+			ProtocolInfo: "http-get:*:video/x-matroska:*", Duration: "0:01:30.500", Size: "1234",
+		}},
+	}
+}
+
+func TestRendererSetAVTransportURI(t *testing.T) {
+	fr, r := newFakeRenderer(t)
+	item := testItem("1", `Tom & Jerry <"1">`)
+	if err := r.SetAVTransportURI(context.Background(), item); err != nil {
+		t.Fatal(err)
+	}
+	call := fr.lastCall()
+	if call.Service != "AVTransport" || call.Action != "SetAVTransportURI" || call.Args["InstanceID"] != "0" {
+		t.Fatalf("got %+v", call)
+	}
+	if got, want := call.Args["CurrentURI"], "http://192.0.2.1:8200/MediaItems/1.mkv"; got != want {
+		t.Errorf("got URI %q, wanted %q", got, want)
+	}
+	// The metadata is an escaped DIDL-Lite document in the SOAP argument.
+	var dl dlna.DIDLLite
+	if err := xml.Unmarshal([]byte(call.Args["CurrentURIMetaData"]), &dl); err != nil {
+		t.Fatalf("parse metadata %q: %+v", call.Args["CurrentURIMetaData"], err)
+	}
+	if len(dl.Items) != 1 {
+		t.Fatalf("got %d items in the metadata, wanted 1", len(dl.Items))
+	}
+	got := dl.Items[0]
+	if got.ID != item.ID || got.Title != item.Title || got.Class != item.Class {
+		t.Errorf("got %q %q %q, wanted %q %q %q", got.ID, got.Title, got.Class, item.ID, item.Title, item.Class)
+	}
+	if res := got.Res(); res.URL != call.Args["CurrentURI"] || res.ProtocolInfo != item.Res().ProtocolInfo {
+		t.Errorf("got resource %+v", res)
+	}
+
+	if err := r.SetNextAVTransportURI(context.Background(), testItem("2", "next")); err != nil {
+		t.Fatal(err)
+	}
+	if call = fr.lastCall(); call.Args["NextURI"] != "http://192.0.2.1:8200/MediaItems/2.mkv" || call.Args["NextURIMetaData"] == "" {
+		t.Errorf("got %+v", call)
+	}
+}
+
+func TestRendererTransport(t *testing.T) {
+	fr, r := newFakeRenderer(t)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name  string
+		f     func(context.Context) error
+		state string
+	}{
+		{"Play", r.Play, "PLAYING"},
+		{"Pause", r.Pause, "PAUSED_PLAYBACK"},
+		{"Play", r.Play, "PLAYING"},
+		{"Stop", r.Stop, "STOPPED"},
+	} {
+		if err := tc.f(ctx); err != nil {
+			t.Fatalf("%s: %+v", tc.name, err)
+		}
+		if call := fr.lastCall(); call.Action != tc.name || call.Args["InstanceID"] != "0" {
+			t.Errorf("%s: got %+v", tc.name, call)
+		} else if tc.name == "Play" && call.Args["Speed"] != "1" {
+			t.Errorf("Play: got speed %q", call.Args["Speed"])
+		}
+		ti, err := r.GetTransportInfo(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ti.CurrentTransportState != tc.state {
+			t.Errorf("%s: got %q, wanted %q", tc.name, ti.CurrentTransportState, tc.state)
+		}
+	}
+}
+
+func TestRendererSeek(t *testing.T) {
+	fr, r := newFakeRenderer(t)
+	ctx := context.Background()
+	for _, target := range []string{"0:00:00", "0:01:02", "12:34:56", "100:00:00.5"} {
+		if err := r.Seek(ctx, target); err != nil {
+			t.Errorf("%q: %+v", target, err)
+			continue
+		}
+		if call := fr.lastCall(); call.Action != "Seek" || call.Args["Unit"] != "REL_TIME" || call.Args["Target"] != target {
+			t.Errorf("%q: got %+v", target, call)
+		}
+	}
+	n := len(fr.actions())
+	for _, target := range []string{"", "1", "1:2:3", "0:1:02", "01:02", "0:00:60x", "-0:00:01", "0:00:01."} {
+		if err := r.Seek(ctx, target); !errors.Is(err, errBadTime) {
+			t.Errorf("%q: got %v, wanted %v", target, err, errBadTime)
+		}
+	}
+	if got := len(fr.actions()); got != n {
+		t.Errorf("the invalid targets made %d calls", got-n)
+	}
+}
+
+func TestRendererPositionInfo(t *testing.T) {
+	fr, r := newFakeRenderer(t)
+	ctx := context.Background()
+	if err := r.SetAVTransportURI(ctx, testItem("1", "a&b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Seek(ctx, "0:00:42"); err != nil {
+		t.Fatal(err)
+	}
+	fr.set(func(fr *fakeRenderer) { fr.uri += "&x=1" })
+	pi, err := r.GetPositionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.TrackURI != "http://192.0.2.1:8200/MediaItems/1.mkv&x=1" || pi.RelTime != "0:00:42" || pi.TrackDuration != "0:01:30.500" {
+		t.Errorf("got %+v", pi)
+	}
+	if got := durationSeconds(pi.TrackDuration); got != 90.5 {
+		t.Errorf("got %v seconds of %q, wanted 90.5", got, pi.TrackDuration)
+	}
+	if got := durationSeconds(pi.RelTime); got != 42 {
+		t.Errorf("got %v seconds of %q, wanted 42", got, pi.RelTime)
+	}
+}
+
+func TestRendererVolume(t *testing.T) {
+	fr, r := newFakeRenderer(t)
+	ctx := context.Background()
+	if err := r.SetVolume(ctx, 55); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetMute(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if call := fr.lastCall(); call.Service != "RenderingControl" || call.Args["Channel"] != "Master" || call.Args["DesiredMute"] != "1" {
+		t.Errorf("got %+v", call)
+	}
+	vol, err := r.GetVolume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol != (Volume{Volume: 55, Mute: true}) {
+		t.Errorf("got %+v", vol)
+	}
+	if err := r.SetVolume(ctx, 101); !errors.Is(err, errBadVolume) {
+		t.Errorf("got %v, wanted %v", err, errBadVolume)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+// Rule hides or pins (lists first) the matching containers or items.
+//
+// The IDs are the ones webdlna shows: prefixed with the server's index ("1:64$0")
+// when there are more than one servers.
+type Rule struct {
+	// Action is "hide" or "pin".
+	Action string `json:"action"`
+	// On restricts the rule to "container"s or "item"s, matching both if empty.
+	On string `json:"on,omitempty"`
+	// Field is the matched field: title, id, class, mime or url (of the main resource).
+	Field string `json:"field"`
+	// Glob (with * and ?) or Regexp is the pattern the whole field must match.
+	Glob   string `json:"glob,omitempty"`
+	Regexp string `json:"regexp,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// defaultRules hide the MiniDLNA's "All Movies"-like aggregate containers, and the thumbnails.
+var defaultRules = []Rule{
+	{Action: "hide", On: "container", Field: "title", Glob: "All *"},
+	{Action: "hide", On: "item", Field: "url", Glob: "*/Thumbnails/*"},
+}
+
+// rules is a compiled list of rules.
+type rules []Rule
+
+// readRules reads the JSON list of rules from the file.
+func readRules(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rs := []Rule{}
+	if err = json.Unmarshal(b, &rs); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", path, err)
+	}
+	return rs, nil
+}
+
+func compileRules(rs []Rule) (rules, error) {
+	compiled := make(rules, len(rs))
+	for i, r := range rs {
+		switch r.Action {
+		case "hide", "pin":
+		default:
+			return nil, fmt.Errorf("rule #%d: unknown action %q", i+1, r.Action)
+		}
+		switch r.On {
+		case "", "container", "item":
+		default:
+			return nil, fmt.Errorf("rule #%d: unknown object %q", i+1, r.On)
+		}
+		switch r.Field {
+		case "title", "id", "class", "mime", "url":
+		default:
+			return nil, fmt.Errorf("rule #%d: unknown field %q", i+1, r.Field)
+		}
+		pattern := r.Regexp
+		if (r.Glob == "") == (r.Regexp == "") {
+			return nil, fmt.Errorf("rule #%d: exactly one of glob and regexp is needed", i+1)
+		} else if r.Glob != "" {
+			pattern = globRegexp(r.Glob)
+		}
+		var err error
+		if r.re, err = regexp.Compile(`^(?:` + pattern + `)$`); err != nil {
+			return nil, fmt.Errorf("rule #%d: %w", i+1, err)
+		}
+		compiled[i] = r
+	}
+	return compiled, nil
+}
+
+func globRegexp(glob string) string {
+	var buf strings.Builder
+	for _, c := range glob {
+		switch c {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteByte('.')
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return buf.String()
+}
+
+// ruleObject is the matchable fields of a container or an item.
+type ruleObject struct {
+	on, title, id, class, mime, url string
+}
+
+func containerObject(c dlna.Container) ruleObject {
+	return ruleObject{on: "container", title: c.Title, id: c.ID, class: c.Class}
+}
+
+func itemObject(i dlna.Item) ruleObject {
+	res := i.Res()
+	return ruleObject{on: "item", title: i.Title, id: i.ID, class: i.Class, mime: res.MimeType(), url: res.URL}
+}
+
+func (r Rule) matches(o ruleObject) bool {
+	if r.On != "" && r.On != o.on {
+		return false
+	}
+	var v string
+	switch r.Field {
+	case "title":
+		v = o.title
+	case "id":
+		v = o.id
+	case "class":
+		v = o.class
+	case "mime":
+		v = o.mime
+	case "url":
+		v = o.url
+	}
+	return r.re.MatchString(v)
+}
+
+// action returns the action of the first matching rule, "" if none matches.
+func (rs rules) action(o ruleObject) string {
+	for _, r := range rs {
+		if r.matches(o) {
+			return r.Action
+		}
+	}
+	return ""
+}
+
+func (rs rules) HideContainer(c dlna.Container) bool { return rs.action(containerObject(c)) == "hide" }
+func (rs rules) HideItem(i dlna.Item) bool           { return rs.action(itemObject(i)) == "hide" }
+
+// Items returns the items without the hidden ones, the pinned ones first.
+func (rs rules) Items(items []dlna.Item) []dlna.Item {
+	var pinned, rest []dlna.Item
+	for _, i := range items {
+		switch rs.action(itemObject(i)) {
+		case "hide":
+		case "pin":
+			pinned = append(pinned, i)
+		default:
+			rest = append(rest, i)
+		}
+	}
+	return slices.Concat(pinned, rest)
+}
+
+// Apply returns the folders without the hidden containers and items, the pinned ones first.
+// Folders left without items are dropped, too.
+func (rs rules) Apply(folders []Folder) []Folder {
+	var pinned, rest []Folder
+	for _, f := range folders {
+		action := rs.action(containerObject(f.Container))
+		if action == "hide" {
+			continue
+		}
+		if f.Items = rs.Items(f.Items); len(f.Items) == 0 && f.Err == nil {
+			continue
+		}
+		if action == "pin" {
+			pinned = append(pinned, f)
+		} else {
+			rest = append(rest, f)
+		}
+	}
+	return slices.Concat(pinned, rest)
+}
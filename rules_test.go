@@ -0,0 +1,153 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+func TestRuleGlob(t *testing.T) {
+	for _, tc := range []struct {
+		glob, s string
+		want    bool
+	}{
+		{"*.mkv", "a.mkv", true},
+		{"*.mkv", ".mkv", true},
+		{"*.mkv", "a.mkv.part", false},
+		{"*.mkv", "a/b.mkv", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a?c", "abbc", false},
+		{"a?c", "xabc", false},
+		{"á?", "áb", true},
+		{"?", "é", true},
+		{"All *", "All Movies", true},
+		{"All *", "Not All Movies", false},
+		{"All *", "All", false},
+
+		// the regexp metacharacters are literal
+		{"a.b", "a.b", true},
+		{"a.b", "axb", false},
+		{"(x)+", "(x)+", true},
+		{"(x)+", "xx", false},
+		{"[ab]", "[ab]", true},
+		{"[ab]", "a", false},
+		{`^a|b$\d`, `^a|b$\d`, true},
+		{`^a|b$\d`, "a", false},
+		{"{1}", "{1}", true},
+	} {
+		rs, err := compileRules([]Rule{{Action: "hide", Field: "title", Glob: tc.glob}})
+		if err != nil {
+			t.Errorf("%q: %+v", tc.glob, err)
+			continue
+		}
+		if got := rs.HideItem(dlna.Item{Title: tc.s}); got != tc.want {
+			t.Errorf("%q matches %q: got %t, wanted %t", tc.glob, tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestRuleRegexpAnchored(t *testing.T) {
+	rs, err := compileRules([]Rule{{Action: "hide", Field: "class", Regexp: `object\.item\.videoItem|object\.item\.audioItem`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for class, want := range map[string]bool{
+		"object.item.videoItem":       true,
+		"object.item.audioItem":       true,
+		"object.item.videoItem.movie": false,
+		"x.object.item.audioItem":     false,
+		"object.item.imageItem":       false,
+	} {
+		if got := rs.HideItem(dlna.Item{Class: class}); got != want {
+			t.Errorf("%q: got %t, wanted %t", class, got, want)
+		}
+	}
+}
+
+// TestDefaultRules checks that the default rules hide what the hard-coded filters did:
+// the containers titled "All ...", and the items with a /Thumbnails/ URL.
+func TestDefaultRules(t *testing.T) {
+	rs, err := compileRules(defaultRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range []string{"All Movies", "All ", "All Music", "Movies", "all Movies", "Alle", "My All Movies", ""} {
+		want := strings.HasPrefix(title, "All ")
+		if got := rs.HideContainer(dlna.Container{Title: title}); got != want {
+			t.Errorf("container %q: got %t, wanted %t", title, got, want)
+		}
+		// the container rule does not hide items
+		if rs.HideItem(dlna.Item{Title: title}) {
+			t.Errorf("item %q is hidden", title)
+		}
+	}
+	for _, u := range []string{
+		"http://192.0.2.1:8200/Thumbnails/1.jpg",
+		"http://192.0.2.1:8200/MediaItems/1.mkv",
+		"http://192.0.2.1:8200/MediaItems/Thumbnails/1.jpg",
+		"http://192.0.2.1:8200/Thumbnails",
+		"http://192.0.2.1:8200/thumbnails/1.jpg",
+		"/Thumbnails/",
+		"",
+	} {
+		want := strings.Contains(u, "/Thumbnails/")
+		if got := rs.HideItem(dlna.Item{Resources: []dlna.Res{{URL: u}}}); got != want {
+			t.Errorf("item %q: got %t, wanted %t", u, got, want)
+		}
+	}
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	for _, r := range []Rule{
+		{Action: "show", Field: "title", Glob: "*"},
+		{Action: "hide", On: "folder", Field: "title", Glob: "*"},
+		{Action: "hide", Field: "name", Glob: "*"},
+		{Action: "hide", Field: "title"},
+		{Action: "hide", Field: "title", Glob: "*", Regexp: ".*"},
+		{Action: "hide", Field: "title", Regexp: "("},
+	} {
+		if _, err := compileRules([]Rule{r}); err == nil {
+			t.Errorf("%+v: no error", r)
+		}
+	}
+}
+
+func TestRulesApply(t *testing.T) {
+	rs, err := compileRules([]Rule{
+		{Action: "pin", On: "item", Field: "title", Glob: "*!"},
+		{Action: "hide", Field: "title", Glob: "x*"},
+		{Action: "pin", On: "container", Field: "id", Glob: "2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := func(id string, titles ...string) Folder {
+		f := Folder{Container: dlna.Container{ID: id, Title: id}}
+		for _, title := range titles {
+			f.Items = append(f.Items, dlna.Item{ID: id + "$" + title, Title: title})
+		}
+		return f
+	}
+	got := rs.Apply([]Folder{
+		folder("1", "a", "b!", "x!", "c", "d!"),
+		folder("x", "a"),
+		folder("2", "a"),
+		folder("3", "xa", "xb"),
+	})
+	var ids []string
+	for _, f := range got {
+		ids = append(ids, f.ID)
+		for _, it := range f.Items {
+			ids = append(ids, it.ID)
+		}
+	}
+	// "x!" is pinned by the first rule before the second could hide it
+	if want := []string{"2", "2$a", "1", "1$b!", "1$x!", "1$d!", "1$a", "1$c"}; !slices.Equal(ids, want) {
+		t.Errorf("got %q, wanted %q", ids, want)
+	}
+}
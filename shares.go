@@ -0,0 +1,392 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+// Share is a link to an item or a folder, usable without authentication until it expires,
+// or its downloads are used up.
+type Share struct {
+	ID string `json:"id"`
+	// Object is the ID of the shared item or folder.
+	Object       string    `json:"object"`
+	Title        string    `json:"title"`
+	Folder       bool      `json:"folder,omitempty"`
+	CreatedBy    string    `json:"createdBy,omitempty"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads,omitempty"`
+}
+
+var (
+	errShareInvalid = errors.New("invalid share link")
+	errShareExpired = errors.New("share link expired")
+	errShareUsedUp  = errors.New("share link used up")
+)
+
+// shares stores the shares, persisted with their signing key in a JSON file if path is not empty.
+type shares struct {
+	path string
+
+	mu   sync.Mutex
+	key  []byte
+	byID map[string]*Share
+}
+
+type sharesFile struct {
+	Key    []byte   `json:"key"`
+	Shares []*Share `json:"shares"`
+}
+
+// Load reads the shares, dropping the expired ones; and generates a new key if there's none.
+func (ss *shares) Load() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.byID = make(map[string]*Share)
+	var sf sharesFile
+	if ss.path != "" {
+		b, err := os.ReadFile(ss.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			if err = json.Unmarshal(b, &sf); err != nil {
+				return fmt.Errorf("parse %q: %w", ss.path, err)
+			}
+		}
+	}
+	if ss.key = sf.Key; len(ss.key) == 0 {
+		ss.key = make([]byte, 32)
+		rand.Read(ss.key)
+	}
+	now := time.Now()
+	for _, s := range sf.Shares {
+		if now.Before(s.Expires) {
+			ss.byID[s.ID] = s
+		}
+	}
+	return ss.saveLocked()
+}
+
+func (ss *shares) saveLocked() error {
+	if ss.path == "" {
+		return nil
+	}
+	sf := sharesFile{Key: ss.key, Shares: make([]*Share, 0, len(ss.byID))}
+	for _, s := range ss.byID {
+		sf.Shares = append(sf.Shares, s)
+	}
+	slices.SortFunc(sf.Shares, func(a, b *Share) int { return a.Created.Compare(b.Created) })
+	b, err := json.MarshalIndent(sf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(ss.path), 0750); err != nil {
+		return err
+	}
+	tmp := ss.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ss.path)
+}
+
+// Create stores the share with a new ID, and returns it.
+func (ss *shares) Create(s Share) (Share, error) {
+	var b [8]byte
+	rand.Read(b[:])
+	s.ID, s.Created = hex.EncodeToString(b[:]), time.Now()
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for id, old := range ss.byID {
+		if !s.Created.Before(old.Expires) {
+			delete(ss.byID, id)
+		}
+	}
+	ss.byID[s.ID] = &s
+	return s, ss.saveLocked()
+}
+
+// List returns the active shares created by user ("" for all), the newest first.
+func (ss *shares) List(user string) []Share {
+	now := time.Now()
+	ss.mu.Lock()
+	list := make([]Share, 0, len(ss.byID))
+	for _, s := range ss.byID {
+		if now.Before(s.Expires) && (user == "" || s.CreatedBy == user) {
+			list = append(list, *s)
+		}
+	}
+	ss.mu.Unlock()
+	slices.SortFunc(list, func(a, b Share) int { return b.Created.Compare(a.Created) })
+	return list
+}
+
+// Revoke deletes the share, if user ("" for anybody) created it.
+func (ss *shares) Revoke(id, user string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.byID[id]
+	if !ok || (user != "" && s.CreatedBy != user) {
+		return fmt.Errorf("share %q: %w", id, errNoSuchObject)
+	}
+	delete(ss.byID, id)
+	return ss.saveLocked()
+}
+
+// Query returns the signed query parameters of the share.
+func (ss *shares) Query(s Share) string {
+	exp := strconv.FormatInt(s.Expires.Unix(), 10)
+	return url.Values{"share": {s.ID}, "exp": {exp}, "sig": {ss.sign(s.ID, s.Object, exp)}}.Encode()
+}
+
+func (ss *shares) sign(id, object, exp string) string {
+	ss.mu.Lock()
+	mac := hmac.New(sha256.New, ss.key)
+	ss.mu.Unlock()
+	mac.Write([]byte(id + "\x00" + object + "\x00" + exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Signed returns the share of the signed query parameters, whether or not it's still usable.
+func (ss *shares) Signed(q url.Values) (Share, error) {
+	s, err := ss.signed(q)
+	if err != nil {
+		return Share{}, err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return *s, nil
+}
+
+func (ss *shares) signed(q url.Values) (*Share, error) {
+	id, exp := q.Get("share"), q.Get("exp")
+	ss.mu.Lock()
+	s, ok := ss.byID[id]
+	var object string
+	if ok {
+		object = s.Object
+	}
+	ss.mu.Unlock()
+	if !ok || exp != strconv.FormatInt(s.Expires.Unix(), 10) ||
+		!hmac.Equal([]byte(q.Get("sig")), []byte(ss.sign(id, object, exp))) {
+		return nil, errShareInvalid
+	}
+	return s, nil
+}
+
+// Verify returns the share of the signed query parameters, if it's still usable.
+// If download is true, it also counts a download, checking and counting it at once.
+func (ss *shares) Verify(q url.Values, download bool) (Share, error) {
+	s, err := ss.signed(q)
+	if err != nil {
+		return Share{}, err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !time.Now().Before(s.Expires) {
+		return Share{}, errShareExpired
+	}
+	if s.MaxDownloads != 0 && s.Downloads >= s.MaxDownloads {
+		return Share{}, errShareUsedUp
+	}
+	if download {
+		s.Downloads++
+		if err := ss.saveLocked(); err != nil {
+			return Share{}, err
+		}
+	}
+	return *s, nil
+}
+
+// MediaQuery returns the signed query parameter of the item's media URL for the DLNA MediaServer's clients,
+// giving access to that item only. It's signed with the shares' key, so it survives restarts.
+func (ss *shares) MediaQuery(id string) string {
+	return url.Values{"dlna": {ss.sign("dlna", id, "")}}.Encode()
+}
+
+// VerifyMedia reports whether the signature of MediaQuery is valid for the item.
+func (ss *shares) VerifyMedia(id, sig string) bool {
+	return hmac.Equal([]byte(sig), []byte(ss.sign("dlna", id, "")))
+}
+
+func shareErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errShareInvalid):
+		return http.StatusForbidden
+	case errors.Is(err, errShareExpired), errors.Is(err, errShareUsedUp):
+		return http.StatusGone
+	}
+	return errorStatus(err)
+}
+
+// Covers reports whether the share gives access to the item.
+func (s Share) Covers(item dlna.Item) bool {
+	return item.ID == s.Object || (s.Folder && item.ParentID == s.Object)
+}
+
+func shareURL(id string) string  { return "/shares/" + url.PathEscape(id) }
+func sharedURL(id string) string { return "/shared/" + url.PathEscape(id) }
+
+// shareLink is a share with its URL, for the management page.
+type shareLink struct {
+	Share
+	URL string
+}
+
+// serveShares lists the active shares of the user (all of them for the unrestricted users).
+func (h *handler) serveShares(w http.ResponseWriter, r *http.Request) {
+	user := h.owner(r)
+	list := h.shares.List(user)
+	links := make([]shareLink, len(list))
+	for i, s := range list {
+		links[i] = shareLink{Share: s, URL: absLink(r.Context(), sharedURL(s.ID)+"?"+h.shares.Query(s))}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(r.Context(), w, printPage("Shares", printShares(links)))
+}
+
+// serveShareCreate shares the item or folder "id" for "expires" (a duration, a week by default),
+// with at most "downloads" downloads (unlimited if empty or zero).
+func (h *handler) serveShareCreate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	s := Share{Object: r.FormValue("id"), CreatedBy: userOf(ctx)}
+	if s.Object == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	expires := 7 * 24 * time.Hour
+	if v := r.FormValue("expires"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "bad expires "+strconv.Quote(v), http.StatusBadRequest)
+			return
+		}
+		expires = d
+	}
+	s.Expires = time.Now().Add(expires).Truncate(time.Second)
+	if v := r.FormValue("downloads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "bad downloads "+strconv.Quote(v), http.StatusBadRequest)
+			return
+		}
+		s.MaxDownloads = n
+	}
+	data, _, err := h.getData(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if i := slices.IndexFunc(data, func(f Folder) bool { return f.ID == s.Object }); i >= 0 {
+		s.Title, s.Folder = data[i].Title, true
+	} else if item, err := h.lookupItem(ctx, s.Object); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	} else {
+		s.Title = item.Title
+	}
+	if s, err = h.shares.Create(s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(ctx, "share", "id", s.ID, "objectID", s.Object, "expires", s.Expires, "maxDownloads", s.MaxDownloads)
+	http.Redirect(w, r, link(r.Context(), "/shares"), http.StatusSeeOther)
+}
+
+func (h *handler) serveShareRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := h.shares.Revoke(r.PathValue("id"), h.owner(r)); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	http.Redirect(w, r, link(r.Context(), "/shares"), http.StatusSeeOther)
+}
+
+// serveShared shows the shared item or the items of the shared folder, without authentication.
+func (h *handler) serveShared(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	if q.Get("share") != r.PathValue("id") {
+		http.Error(w, errShareInvalid.Error(), http.StatusForbidden)
+		return
+	}
+	s, err := h.shares.Verify(q, false)
+	if err != nil {
+		http.Error(w, err.Error(), shareErrorStatus(err))
+		return
+	}
+	var items []dlna.Item
+	var subs []Subtitle
+	if s.Folder {
+		data, _, err := h.getData(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		i := slices.IndexFunc(data, func(f Folder) bool { return f.ID == s.Object })
+		if i < 0 {
+			http.Error(w, fmt.Errorf("folder %q: %w", s.Object, errNoSuchObject).Error(), http.StatusNotFound)
+			return
+		}
+		items = data[i].Items
+	} else {
+		folder, item, err := h.lookup(ctx, s.Object)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		items, subs = []dlna.Item{item}, folder.Subtitles(item)
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(ctx, w, printSharedPage(s.Title, printShared(s, items, subs, h.shares.Query(s))))
+}
+
+// isDownload reports whether the media request is a download to count: a GET of the whole media
+// (a player may ask for any parts of it, or probe its beginning).
+func isDownload(r *http.Request) bool {
+	rng := r.Header.Get("Range")
+	return r.Method == http.MethodGet && (rng == "" || strings.TrimSpace(rng) == "bytes=0-")
+}
+
+// sharedItem returns the item of the share link of the media request, counting a download, see isDownload.
+func (h *handler) sharedItem(r *http.Request) (dlna.Item, error) {
+	q := r.URL.Query()
+	s, err := h.shares.Signed(q)
+	if err != nil {
+		return dlna.Item{}, err
+	}
+	item, err := h.lookupItem(r.Context(), r.PathValue("id"))
+	if err != nil {
+		return item, err
+	}
+	if !s.Covers(item) {
+		return dlna.Item{}, errShareInvalid
+	}
+	if _, err = h.shares.Verify(q, isDownload(r)); err != nil {
+		return dlna.Item{}, err
+	}
+	return item, nil
+}
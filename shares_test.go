@@ -0,0 +1,253 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+func newTestShares(t *testing.T) *shares {
+	t.Helper()
+	ss := &shares{path: filepath.Join(t.TempDir(), "shares.json")}
+	if err := ss.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+func TestShareVerify(t *testing.T) {
+	ss := newTestShares(t)
+	s, err := ss.Create(Share{Object: "64$1", Expires: time.Now().Add(time.Hour).Truncate(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ss.Create(Share{Object: "64$2", Expires: s.Expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := url.ParseQuery(ss.Query(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ss.Verify(q, false); err != nil || got.ID != s.ID {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+
+	oq, _ := url.ParseQuery(ss.Query(other))
+	for name, tamper := range map[string]func(url.Values){
+		"signature":    func(q url.Values) { q.Set("sig", q.Get("sig")[1:]+"A") },
+		"no signature": func(q url.Values) { q.Del("sig") },
+		"expiry": func(q url.Values) {
+			q.Set("exp", strconv.FormatInt(s.Expires.Add(time.Hour).Unix(), 10))
+		},
+		"other share's signature": func(q url.Values) { q.Set("sig", oq.Get("sig")) },
+		"other share":             func(q url.Values) { q.Set("share", other.ID) },
+		"unknown share":           func(q url.Values) { q.Set("share", "0123456789abcdef") },
+	} {
+		tq := url.Values{}
+		for k, v := range q {
+			tq[k] = append([]string(nil), v...)
+		}
+		tamper(tq)
+		if _, err := ss.Verify(tq, false); !errors.Is(err, errShareInvalid) {
+			t.Errorf("%s: got %v, wanted %v", name, err, errShareInvalid)
+		}
+	}
+
+	// a new key invalidates all the links
+	ss2 := &shares{}
+	if err := ss2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	ss2.byID[s.ID] = &s
+	if _, err := ss2.Verify(q, false); !errors.Is(err, errShareInvalid) {
+		t.Errorf("other key: got %v, wanted %v", err, errShareInvalid)
+	}
+
+	// the key and the shares survive a restart
+	ss3 := &shares{path: ss.path}
+	if err := ss3.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss3.Verify(q, false); err != nil {
+		t.Errorf("after reload: %+v", err)
+	}
+}
+
+func TestShareExpiry(t *testing.T) {
+	ss := newTestShares(t)
+	s, err := ss.Create(Share{Object: "1", Expires: time.Now().Add(-time.Second).Truncate(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := url.ParseQuery(ss.Query(s))
+	if _, err = ss.Verify(q, false); !errors.Is(err, errShareExpired) {
+		t.Errorf("got %v, wanted %v", err, errShareExpired)
+	}
+	if got := shareErrorStatus(err); got != 410 {
+		t.Errorf("got status %d, wanted 410", got)
+	}
+	if list := ss.List(""); len(list) != 0 {
+		t.Errorf("expired shares are listed: %+v", list)
+	}
+	// the expired ones are dropped on load
+	if err := ss.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Verify(q, false); !errors.Is(err, errShareInvalid) {
+		t.Errorf("after reload: got %v, wanted %v", err, errShareInvalid)
+	}
+}
+
+func TestShareDownloads(t *testing.T) {
+	ss := newTestShares(t)
+	s, err := ss.Create(Share{Object: "1", Expires: time.Now().Add(time.Hour), MaxDownloads: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := url.ParseQuery(ss.Query(s))
+	for i := range 5 {
+		if _, err := ss.Verify(q, false); err != nil {
+			t.Fatalf("%d. view: %+v", i, err)
+		}
+	}
+	for i := range 2 {
+		if got, err := ss.Verify(q, true); err != nil || got.Downloads != i+1 {
+			t.Fatalf("%d. download: got %d, %v", i, got.Downloads, err)
+		}
+	}
+	for _, download := range []bool{false, true} {
+		if _, err := ss.Verify(q, download); !errors.Is(err, errShareUsedUp) {
+			t.Errorf("got %v, wanted %v", err, errShareUsedUp)
+		}
+	}
+}
+
+func TestIsDownload(t *testing.T) {
+	for _, tc := range []struct {
+		method, rng string
+		want        bool
+	}{
+		{"GET", "", true},
+		{"GET", "bytes=0-", true},
+		{"GET", "bytes=0-1", false},
+		{"GET", "bytes=0-1023", false},
+		{"GET", "bytes=1024-", false},
+		{"GET", "bytes=100-200", false},
+		{"HEAD", "", false},
+		{"HEAD", "bytes=0-", false},
+		{"POST", "", false},
+	} {
+		r := httptest.NewRequest(tc.method, "/media/1?share=x", nil)
+		if tc.rng != "" {
+			r.Header.Set("Range", tc.rng)
+		}
+		if got := isDownload(r); got != tc.want {
+			t.Errorf("%s %q: got %t, wanted %t", tc.method, tc.rng, got, tc.want)
+		}
+	}
+}
+
+func TestShareCovers(t *testing.T) {
+	item := Share{Object: "64$1"}
+	folder := Share{Object: "64", Folder: true}
+	for _, tc := range []struct {
+		s    Share
+		item dlna.Item
+		want bool
+	}{
+		{item, dlna.Item{ID: "64$1", ParentID: "64"}, true},
+		{item, dlna.Item{ID: "64$2", ParentID: "64"}, false},
+		{item, dlna.Item{ID: "64$1$1", ParentID: "64$1"}, false},
+		{folder, dlna.Item{ID: "64$1", ParentID: "64"}, true},
+		{folder, dlna.Item{ID: "64", ParentID: "0"}, true},
+		{folder, dlna.Item{ID: "64$1$1", ParentID: "64$1"}, false},
+		{folder, dlna.Item{ID: "640$1", ParentID: "640"}, false},
+		{Share{Object: "64"}, dlna.Item{ID: "64$1", ParentID: "64"}, false},
+	} {
+		if got := tc.s.Covers(tc.item); got != tc.want {
+			t.Errorf("%+v covers %q (in %q): got %t, wanted %t", tc.s, tc.item.ID, tc.item.ParentID, got, tc.want)
+		}
+	}
+}
+
+func TestMediaSignature(t *testing.T) {
+	ss := newTestShares(t)
+	q, err := url.ParseQuery(ss.MediaQuery("64$1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := q.Get("dlna")
+	if !ss.VerifyMedia("64$1", sig) {
+		t.Error("valid signature rejected")
+	}
+	for _, tc := range []struct{ id, sig string }{
+		{"64$2", sig},
+		{"64$1", ""},
+		{"64$1", sig[1:] + "A"},
+	} {
+		if ss.VerifyMedia(tc.id, tc.sig) {
+			t.Errorf("%q %q accepted", tc.id, tc.sig)
+		}
+	}
+}
+
+func TestSharedDownloadsConcurrent(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("movie"))
+	}))
+	defer upstream.Close()
+	h := newHandler(&dlna.Client{})
+	if err := h.configure(defaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	h.shares.path = filepath.Join(t.TempDir(), "shares.json")
+	if err := h.shares.Load(); err != nil {
+		t.Fatal(err)
+	}
+	h.library.Store(&library{data: []Folder{{Container: dlna.Container{ID: "64"}, Items: []dlna.Item{
+		{ID: "64$1", ParentID: "64", Title: "Movie.mkv",
+			Resources: []dlna.Res{{URL: upstream.URL + "/movie.mkv", ProtocolInfo: "http-get:*:video/x-matroska:*"}}},
+	}}}, fillTime: time.Now(), expires: time.Now().Add(time.Hour)})
+	const n, extra = 3, 7
+	s, err := h.shares.Create(Share{Object: "64$1", Expires: time.Now().Add(time.Hour), MaxDownloads: n})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := mediaURL("64$1") + "?" + h.shares.Query(s)
+
+	var wg sync.WaitGroup
+	codes := make([]int, n+extra)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			codes[i] = w.Code
+		}()
+	}
+	wg.Wait()
+	var ok, gone int
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			ok++
+		case http.StatusGone:
+			gone++
+		}
+	}
+	if ok != n || gone != extra {
+		t.Errorf("got %d successes and %d used up (%v), wanted %d and %d", ok, gone, codes, n, extra)
+	}
+}
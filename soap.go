@@ -0,0 +1,89 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+// soapArg is an argument of a SOAP response - the order of the arguments matters.
+type soapArg struct{ Name, Value string }
+
+// parseSOAPRequest returns the action (from the SOAPAction header) and the arguments of the request.
+func parseSOAPRequest(r *http.Request) (string, map[string]string, error) {
+	_, action, ok := strings.Cut(strings.Trim(r.Header.Get("SOAPAction"), `" `), "#")
+	if !ok {
+		return "", nil, fmt.Errorf("bad SOAPAction %q", r.Header.Get("SOAPAction"))
+	}
+	var envelope struct {
+		Body struct {
+			Action struct {
+				Args []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&envelope); err != nil {
+		return action, nil, err
+	}
+	args := make(map[string]string, len(envelope.Body.Action.Args))
+	for _, a := range envelope.Body.Action.Args {
+		args[a.XMLName.Local] = a.Value
+	}
+	return action, args, nil
+}
+
+func writeSOAPResponse(w http.ResponseWriter, serviceType, action string, args []soapArg) {
+	var buf strings.Builder
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:` +
+		action + `Response xmlns:u="` + serviceType + `">`)
+	for _, a := range args {
+		buf.WriteString("<" + a.Name + ">")
+		xml.EscapeText(&buf, []byte(a.Value))
+		buf.WriteString("</" + a.Name + ">")
+	}
+	buf.WriteString(`</u:` + action + `Response></s:Body></s:Envelope>`)
+	w.Header().Set("Content-Type", dlna.ContentType)
+	w.Header().Set("EXT", "")
+	io.WriteString(w, buf.String())
+}
+
+func writeSOAPFault(w http.ResponseWriter, err error) {
+	var ue *dlna.UPnPError
+	if !errors.As(err, &ue) {
+		ue = &dlna.UPnPError{Code: 501, Description: err.Error()}
+	}
+	var buf strings.Builder
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>` +
+		strconv.Itoa(ue.Code) + `</errorCode><errorDescription>`)
+	xml.EscapeText(&buf, []byte(ue.Description))
+	buf.WriteString(`</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+	w.Header().Set("Content-Type", dlna.ContentType)
+	w.WriteHeader(http.StatusInternalServerError)
+	io.WriteString(w, buf.String())
+}
+
+// errorStatus returns the HTTP status code for the error of an upstream call:
+// 404 for the missing objects, 502 otherwise.
+func errorStatus(err error) int {
+	var ue *dlna.UPnPError
+	if errors.As(err, &ue) {
+		switch ue.Code {
+		case 701, 710, 714:
+			return http.StatusNotFound
+		}
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,286 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+// sortCaps is the properties the items can be sorted by locally.
+const sortCaps = "dc:title,dc:creator,dc:date,upnp:class,res@size,res@duration"
+
+var errBadSort = dlna.NewUPnPError(709)
+
+// sortKey is a property to sort by.
+type sortKey struct {
+	Prop string
+	Desc bool
+}
+
+// parseSortCriteria parses the comma-separated list of +property or -property
+// (ascending if there's no sign).
+func parseSortCriteria(s string) ([]sortKey, error) {
+	var keys []sortKey
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		var k sortKey
+		switch f[0] {
+		case '-':
+			k.Desc, f = true, f[1:]
+		case '+':
+			f = f[1:]
+		}
+		if !slices.Contains(strings.Split(sortCaps, ","), f) {
+			return nil, fmt.Errorf("sort by %q: %w", f, errBadSort)
+		}
+		k.Prop = f
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// sortCriteria returns the SortCriteria of the keys.
+func sortCriteria(keys []sortKey) string {
+	var buf strings.Builder
+	for i, k := range keys {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		if k.Desc {
+			buf.WriteByte('-')
+		} else {
+			buf.WriteByte('+')
+		}
+		buf.WriteString(k.Prop)
+	}
+	return buf.String()
+}
+
+// sortItems returns the items sorted by the keys, leaving the original intact.
+//
+// Numbers (sizes) and durations are compared as numbers, everything else case-insensitively.
+func sortItems(items []dlna.Item, keys []sortKey) []dlna.Item {
+	if len(keys) == 0 {
+		return items
+	}
+	items = slices.Clone(items)
+	slices.SortStableFunc(items, func(a, b dlna.Item) int {
+		for _, k := range keys {
+			c := compareProperty(k.Prop, itemProperty(a, k.Prop), itemProperty(b, k.Prop))
+			if k.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+	return items
+}
+
+func compareProperty(prop, a, b string) int {
+	if prop == "res@duration" {
+		return cmp.Compare(durationSeconds(a), durationSeconds(b))
+	}
+	if x, err := strconv.ParseFloat(a, 64); err == nil {
+		if y, err := strconv.ParseFloat(b, 64); err == nil {
+			return cmp.Compare(x, y)
+		}
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// durationSeconds returns the seconds of the H+:MM:SS[.F+] duration, 0 if it's malformed.
+func durationSeconds(s string) float64 {
+	var secs float64
+	for _, f := range strings.SplitN(s, ":", 3) {
+		x, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return 0
+		}
+		secs = secs*60 + x
+	}
+	return secs
+}
+
+// filterItems returns the items whose title contains q, case-insensitively.
+func filterItems(items []dlna.Item, q string) []dlna.Item {
+	if q = strings.ToLower(strings.TrimSpace(q)); q == "" {
+		return items
+	}
+	var found []dlna.Item
+	for _, i := range items {
+		if strings.Contains(strings.ToLower(i.Title), q) {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+// listQuery is the sorting and the filtering of the item lists, from the "sort" and "q" query parameters.
+type listQuery struct {
+	Sort string
+	Q    string
+	keys []sortKey
+}
+
+func parseListQuery(r *http.Request) (listQuery, error) {
+	lq := listQuery{Sort: r.URL.Query().Get("sort"), Q: r.URL.Query().Get("q")}
+	var err error
+	lq.keys, err = parseSortCriteria(lq.Sort)
+	return lq, err
+}
+
+// dir returns "asc" or "desc" if the list is sorted by prop first, "" otherwise.
+func (lq listQuery) dir(prop string) string {
+	if len(lq.keys) == 0 || lq.keys[0].Prop != prop {
+		return ""
+	}
+	if lq.keys[0].Desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+// sortURL returns the query string sorting by prop, in the opposite direction if it's sorted by prop already.
+func (lq listQuery) sortURL(prop string) string {
+	sort := "+" + prop
+	if lq.dir(prop) == "asc" {
+		sort = "-" + prop
+	}
+	v := url.Values{"sort": {sort}}
+	if lq.Q != "" {
+		v.Set("q", lq.Q)
+	}
+	return "?" + v.Encode()
+}
+
+// SortCapabilities returns the properties the server can sort by, asking it only once.
+// A server not supporting GetSortCapabilities can't sort.
+func (c *crawler) SortCapabilities(ctx context.Context, baseURL string) []string {
+	c.mu.Lock()
+	caps, ok := c.sortCaps[baseURL]
+	root, described := c.roots[baseURL]
+	c.mu.Unlock()
+	if ok {
+		return caps
+	}
+	if !described {
+		var err error
+		if root, err = c.describe(ctx, baseURL); err != nil {
+			slog.WarnContext(ctx, "sort capabilities", "upstream", baseURL, "error", err)
+			return nil
+		}
+	}
+	release, err := c.limiter(baseURL).acquire(ctx)
+	if err != nil {
+		return nil
+	}
+	caps, err = c.client.GetSortCapabilities(ctx, root)
+	release()
+	if err != nil {
+		slog.WarnContext(ctx, "sort capabilities", "upstream", baseURL, "error", err)
+		// ask again next time, unless the server does not know the action
+		if !errors.Is(err, errInvalidAction) {
+			return nil
+		}
+		caps = nil
+	}
+	c.mu.Lock()
+	if c.sortCaps == nil {
+		c.sortCaps = make(map[string][]string)
+	}
+	c.sortCaps[baseURL] = caps
+	c.mu.Unlock()
+	return caps
+}
+
+// canSort reports whether the server's sort capabilities cover all the keys.
+func canSort(caps []string, keys []sortKey) bool {
+	if slices.Contains(caps, "*") {
+		return true
+	}
+	for _, k := range keys {
+		if !slices.Contains(caps, k.Prop) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sorted returns the children of the folder with the server's own ID, sorted by the server.
+// The results are cached for the snapshot of fillTime.
+func (c *crawler) Sorted(ctx context.Context, baseURL, id string, keys []sortKey, fillTime time.Time) (dlna.DIDLLite, error) {
+	key := baseURL + "\x00" + id + "\x00" + sortCriteria(keys)
+	c.mu.Lock()
+	root := c.roots[baseURL]
+	if !c.sortedTime.Equal(fillTime) {
+		c.sortedTime, c.sorted = fillTime, make(map[string]dlna.DIDLLite)
+	}
+	dl, ok := c.sorted[key]
+	c.mu.Unlock()
+	if ok {
+		return dl, nil
+	}
+	lim := c.limiter(baseURL)
+	err := c.retry(ctx, func(ctx context.Context) error {
+		release, err := lim.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		ctx, sp := startSpan(ctx, "Browse", spanKindInternal,
+			spanAttr{"upstream", baseURL}, spanAttr{"objectID", id}, spanAttr{"sortCriteria", sortCriteria(keys)})
+		res, err := c.client.Browse(ctx, root, dlna.BrowseRequest{ObjectID: id, SortCriteria: sortCriteria(keys)})
+		dl = res.DIDLLite
+		sp.SetAttr("items", len(res.Items))
+		sp.SetAttr("totalMatches", res.TotalMatches)
+		sp.End(err)
+		return err
+	})
+	if err != nil {
+		return dl, fmt.Errorf("browse %q sorted by %s: %w", id, sortCriteria(keys), err)
+	}
+	c.mu.Lock()
+	if c.sortedTime.Equal(fillTime) {
+		c.sorted[key] = dl
+	}
+	c.mu.Unlock()
+	return dl, nil
+}
+
+// sortedItems returns the items of the folder sorted by keys: by the upstream server,
+// if it supports sorting by all the keys, locally otherwise - the pinned ones first.
+func (h *handler) sortedItems(ctx context.Context, folder Folder, keys []sortKey, fillTime time.Time) []dlna.Item {
+	if len(keys) == 0 {
+		return folder.Items
+	}
+	s := h.conf()
+	if n, id, ok := s.splitID(folder.ID); ok && canSort(h.crawler.SortCapabilities(ctx, s.servers[n]), keys) {
+		dl, err := h.crawler.Sorted(ctx, s.servers[n], id, keys, fillTime)
+		if err == nil {
+			f := Folder{Items: dl.Items}
+			if len(s.servers) > 1 {
+				f = f.qualify(n)
+			}
+			return s.rules.Items(f.Items)
+		}
+		slog.WarnContext(ctx, "sort upstream", "upstream", s.servers[n], "objectID", id, "error", err)
+	}
+	return s.rules.Items(sortItems(folder.Items, keys))
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+const fakeServerDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><device><deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+<friendlyName>fake</friendlyName><UDN>uuid:fake</UDN><serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:ContentDirectory:1</serviceType><controlURL>/ctl</controlURL></service>
+</serviceList></device></root>`
+
+// fakeContentDirectory answers GetSortCapabilities with caps, or with the UPnP error fault if not zero,
+// and Browse with a single item; it counts the calls by action.
+func fakeContentDirectory(t *testing.T, caps string, fault int) (string, func(action string) int) {
+	t.Helper()
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(fakeServerDesc))
+			return
+		}
+		_, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPAction"), `"`), "#")
+		mu.Lock()
+		calls[action]++
+		mu.Unlock()
+		w.Header().Set("Content-Type", dlna.ContentType)
+		var body string
+		switch {
+		case action == "GetSortCapabilities" && fault != 0:
+			w.WriteHeader(http.StatusInternalServerError)
+			body = fmt.Sprintf(`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode></UPnPError></detail></s:Fault>`, fault)
+		case action == "GetSortCapabilities":
+			body = `<u:GetSortCapabilitiesResponse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1"><SortCaps>` + caps + `</SortCaps></u:GetSortCapabilitiesResponse>`
+		default:
+			body = `<u:BrowseResponse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1"><Result>` +
+				`&lt;DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/"&gt;` +
+				`&lt;item id="1" parentID="0"&gt;&lt;dc:title&gt;a&lt;/dc:title&gt;&lt;/item&gt;&lt;/DIDL-Lite&gt;` +
+				`</Result><NumberReturned>1</NumberReturned><TotalMatches>1</TotalMatches><UpdateID>1</UpdateID></u:BrowseResponse>`
+		}
+		w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+			body + `</s:Body></s:Envelope>`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func(action string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls[action]
+	}
+}
+
+func TestSortCapabilities(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		caps      string
+		fault     int
+		want      string
+		wantCalls int
+	}{
+		{"supported", "dc:title,upnp:class", 0, "dc:title,upnp:class", 1},
+		{"none", "", 0, "", 1},
+		{"invalid action", "", 401, "", 1},
+		{"action failed", "", 501, "", 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			baseURL, calls := fakeContentDirectory(t, tc.caps, tc.fault)
+			c := &crawler{client: &dlna.Client{}}
+			for range 3 {
+				if got := strings.Join(c.SortCapabilities(context.Background(), baseURL), ","); got != tc.want {
+					t.Errorf("got %q, wanted %q", got, tc.want)
+				}
+			}
+			if got := calls("GetSortCapabilities"); got != tc.wantCalls {
+				t.Errorf("got %d calls, wanted %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestSortedCache(t *testing.T) {
+	baseURL, calls := fakeContentDirectory(t, "*", 0)
+	c := &crawler{client: &dlna.Client{}}
+	ctx := context.Background()
+	c.SortCapabilities(ctx, baseURL)
+	byTitle := []sortKey{{Prop: "dc:title"}}
+	fillTime := time.Now()
+	for i, tc := range []struct {
+		keys      []sortKey
+		fillTime  time.Time
+		wantCalls int
+	}{
+		{byTitle, fillTime, 1},
+		{byTitle, fillTime, 1},
+		{[]sortKey{{Prop: "dc:title", Desc: true}}, fillTime, 2},
+		{byTitle, fillTime.Add(time.Minute), 3},
+		{byTitle, fillTime.Add(time.Minute), 3},
+	} {
+		dl, err := c.Sorted(ctx, baseURL, "0", tc.keys, tc.fillTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dl.Items) != 1 || dl.Items[0].Title != "a" {
+			t.Errorf("%d. got %+v", i, dl.Items)
+		}
+		if got := calls("Browse"); got != tc.wantCalls {
+			t.Errorf("%d. got %d calls, wanted %d", i, got, tc.wantCalls)
+		}
+	}
+}
+
+func TestDurationSeconds(t *testing.T) {
+	for s, want := range map[string]float64{
+		"0:00:00":         0,
+		"0:01:30.500":     90.5,
+		"1:00:00":         3600,
+		"10:00:01.25":     36001.25,
+		"1:30":            90,
+		"42":              42,
+		"":                0,
+		"NOT_IMPLEMENTED": 0,
+		"0:xx:01":         0,
+	} {
+		if got := durationSeconds(s); got != want {
+			t.Errorf("%q: got %v, wanted %v", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+// ssdpAdvertise announces the device with the given notification types on the network
+// and answers the M-SEARCH requests, until ctx is done, when it says byebye.
+//
+// The LOCATION is http://host:port/path, where host is the address of the
+// interface the request came on, if host is empty.
+func ssdpAdvertise(ctx context.Context, uuid, host string, port int, path string, types []string) error {
+	group, err := net.ResolveUDPAddr("udp4", dlna.SSDPAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	nts := append([]string{"upnp:rootdevice", "uuid:" + uuid}, types...)
+	usn := func(nt string) string {
+		if nt == "uuid:"+uuid {
+			return nt
+		}
+		return "uuid:" + uuid + "::" + nt
+	}
+	location := func(remote *net.UDPAddr) string {
+		h := host
+		if h == "" {
+			h = "127.0.0.1"
+			if c, err := net.DialUDP("udp4", nil, remote); err == nil {
+				h = c.LocalAddr().(*net.UDPAddr).IP.String()
+				c.Close()
+			}
+		}
+		return "http://" + net.JoinHostPort(h, strconv.Itoa(port)) + path
+	}
+	const server = "Linux/1.0 UPnP/1.0 webdlna/1.0"
+	notify := func(sub string) {
+		for _, nt := range nts {
+			msg := "NOTIFY * HTTP/1.1\r\n" +
+				"HOST: " + dlna.SSDPAddr + "\r\n" +
+				"CACHE-CONTROL: max-age=1800\r\n" +
+				"LOCATION: " + location(group) + "\r\n" +
+				"NT: " + nt + "\r\n" +
+				"NTS: " + sub + "\r\n" +
+				"SERVER: " + server + "\r\n" +
+				"USN: " + usn(nt) + "\r\n\r\n"
+			if _, err := conn.WriteToUDP([]byte(msg), group); err != nil {
+				slog.WarnContext(ctx, "ssdp notify", "error", err)
+			}
+		}
+	}
+	respond := func(remote *net.UDPAddr, st string) {
+		for _, nt := range nts {
+			if st != "ssdp:all" && st != nt {
+				continue
+			}
+			msg := "HTTP/1.1 200 OK\r\n" +
+				"CACHE-CONTROL: max-age=1800\r\n" +
+				"DATE: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+				"EXT:\r\n" +
+				"LOCATION: " + location(remote) + "\r\n" +
+				"SERVER: " + server + "\r\n" +
+				"ST: " + nt + "\r\n" +
+				"USN: " + usn(nt) + "\r\n" +
+				"Content-Length: 0\r\n\r\n"
+			if _, err := conn.WriteToUDP([]byte(msg), remote); err != nil {
+				slog.WarnContext(ctx, "ssdp respond", "remote", remote, "error", err)
+			}
+		}
+	}
+
+	go func() {
+		notify("ssdp:alive")
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				notify("ssdp:byebye")
+				conn.Close()
+				return
+			case <-ticker.C:
+				notify("ssdp:alive")
+			}
+		}
+	}()
+
+	buf := make([]byte, 8192)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("Man") != `"ssdp:discover"` {
+			continue
+		}
+		st := req.Header.Get("St")
+		mx, _ := strconv.Atoi(req.Header.Get("Mx"))
+		delay := time.Duration(rand.Int64N(int64(max(1, min(mx, 5)) * int(time.Second) / 2)))
+		time.AfterFunc(delay, func() { respond(remote, st) })
+	}
+}
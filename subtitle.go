@@ -0,0 +1,187 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+// Subtitle is a sidecar subtitle of an item.
+type Subtitle struct {
+	URL  string
+	Type string // srt or vtt
+	Lang string
+}
+
+func (s Subtitle) Label() string {
+	if s.Lang != "" {
+		return s.Lang
+	}
+	return s.Type
+}
+
+// Subtitles returns the subtitles of the item: the ones announced in the item itself,
+// and the subtitle items in the same folder whose title matches the item's title.
+func (f Folder) Subtitles(item dlna.Item) []Subtitle {
+	var subs []Subtitle
+	seen := make(map[string]struct{})
+	add := func(s Subtitle) {
+		if s.URL == "" || s.Type == "" {
+			return
+		}
+		if _, ok := seen[s.URL]; ok {
+			return
+		}
+		seen[s.URL] = struct{}{}
+		subs = append(subs, s)
+	}
+	for _, c := range slices.Concat(item.CaptionInfoEx, item.CaptionInfo) {
+		add(Subtitle{URL: strings.TrimSpace(c.URL), Type: dlna.SubtitleType("text/"+strings.ToLower(c.Type), c.URL)})
+	}
+	for _, r := range item.Resources {
+		add(Subtitle{URL: r.URL, Type: dlna.SubtitleType(r.MimeType(), r.URL)})
+	}
+
+	base := strings.TrimSuffix(item.Title, path.Ext(item.Title))
+	for _, sibling := range f.Items {
+		if sibling.ID == item.ID {
+			continue
+		}
+		name := strings.TrimSuffix(sibling.Title, path.Ext(sibling.Title))
+		lang := ""
+		if name != base {
+			var ok bool
+			if name, lang, ok = cutLang(name); !ok || name != base {
+				continue
+			}
+		}
+		for _, r := range sibling.Resources {
+			add(Subtitle{URL: r.URL, Type: dlna.SubtitleType(r.MimeType(), r.URL), Lang: lang})
+		}
+	}
+	return subs
+}
+
+// cutLang cuts the language code from the end of "movie.en".
+func cutLang(name string) (string, string, bool) {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 || len(name)-i-1 < 2 || len(name)-i-1 > 3 {
+		return name, "", false
+	}
+	lang := name[i+1:]
+	for _, c := range lang {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return name, "", false
+		}
+	}
+	return name[:i], strings.ToLower(lang), true
+}
+
+func subtitleURL(id string, n int) string {
+	return "/subtitles/" + url.PathEscape(id) + "/" + strconv.Itoa(n)
+}
+
+// serveSubtitle serves the n-th subtitle of the item as WebVTT;
+// with a share link's query parameters, without authentication.
+func (h *handler) serveSubtitle(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var share Share
+	if q := r.URL.Query(); q.Has("share") {
+		if share, err = h.shares.Verify(q, false); err != nil {
+			http.Error(w, err.Error(), shareErrorStatus(err))
+			return
+		}
+	}
+	folder, item, err := h.lookup(ctx, r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if share.ID != "" && !share.Covers(item) {
+		http.Error(w, errShareInvalid.Error(), http.StatusForbidden)
+		return
+	}
+	subs := folder.Subtitles(item)
+	if n < 0 || n >= len(subs) {
+		http.Error(w, r.URL.Path+" Not Found", http.StatusNotFound)
+		return
+	}
+	sub := subs[n]
+
+	req, err := http.NewRequestWithContext(ctx, "GET", sub.URL, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := cmp.Or(h.client.HTTPClient, http.DefaultClient).Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, sub.URL+": "+resp.Status, http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	if err := srtToVTT(w, resp.Body); err != nil {
+		slog.WarnContext(ctx, "convert subtitle", "url", sub.URL, "error", err)
+	}
+}
+
+var srtTimestamp = regexp.MustCompile(`(\d+:\d{2}:\d{2}),(\d{3})`)
+
+// srtToVTT converts the SRT subtitle to WebVTT.
+// Input already in WebVTT format is copied as is.
+//
+// SRT files are frequently not UTF-8, so invalid UTF-8 is read as Latin-1.
+func srtToVTT(w io.Writer, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(b) {
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		b = []byte(string(runes))
+	}
+	if bytes.HasPrefix(b, []byte("WEBVTT")) {
+		_, err = w.Write(b)
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n\n")
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.Contains(line, "-->") {
+			line = srtTimestamp.ReplaceAllString(line, "$1.$2")
+		}
+		bw.WriteString(line)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,163 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+func TestSrtToVTT(t *testing.T) {
+	const vtt = "WEBVTT\n\n1\n00:00:01.500 --> 00:00:03.000\nHello, world\n\n"
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"srt", "1\n00:00:01,500 --> 00:00:03,000\nHello, world\n", vtt},
+		{"crlf", "1\r\n00:00:01,500 --> 00:00:03,000\r\nHello, world\r\n", vtt},
+		{"bom", "\xef\xbb\xbf1\n00:00:01,500 --> 00:00:03,000\nHello, world\n", vtt},
+		{"latin-1", "1\n00:00:01,500 --> 00:00:03,000\n\xc1rv\xedzt\xfbr\xf5\n",
+			"WEBVTT\n\n1\n00:00:01.500 --> 00:00:03.000\nÁrvíztûrõ\n\n"},
+		{"utf-8", "1\n00:00:01,500 --> 00:00:03,000\nÁrvíztűrő\n",
+			"WEBVTT\n\n1\n00:00:01.500 --> 00:00:03.000\nÁrvíztűrő\n\n"},
+		// only the timestamps of the cue timings are rewritten
+		{"text commas", "2\n10:01:02,003 --> 10:01:04,000\nat 0:00:01,500 sharp\n",
+			"WEBVTT\n\n2\n10:01:02.003 --> 10:01:04.000\nat 0:00:01,500 sharp\n\n"},
+		{"vtt", "WEBVTT\n\n00:00:01.500 --> 00:00:03.000\nHi\n", "WEBVTT\n\n00:00:01.500 --> 00:00:03.000\nHi\n"},
+		{"vtt with bom", "\xef\xbb\xbfWEBVTT\n\nHi\n", "WEBVTT\n\nHi\n"},
+		{"empty", "", "WEBVTT\n\n\n"},
+	} {
+		var buf strings.Builder
+		if err := srtToVTT(&buf, strings.NewReader(tc.in)); err != nil {
+			t.Fatalf("%s: %+v", tc.name, err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: got %q, wanted %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCutLang(t *testing.T) {
+	for _, tc := range []struct {
+		in, name, lang string
+		ok             bool
+	}{
+		{"movie.en", "movie", "en", true},
+		{"movie.HUN", "movie", "hun", true},
+		{"the.movie.2020.de", "the.movie.2020", "de", true},
+		{"movie", "movie", "", false},
+		{"movie.e", "movie.e", "", false},
+		{"movie.engl", "movie.engl", "", false},
+		{"movie.e1", "movie.e1", "", false},
+		{"movie.", "movie.", "", false},
+		{".en", "", "en", true},
+	} {
+		name, lang, ok := cutLang(tc.in)
+		if name != tc.name || lang != tc.lang || ok != tc.ok {
+			t.Errorf("%q: got %q %q %t, wanted %q %q %t", tc.in, name, lang, ok, tc.name, tc.lang, tc.ok)
+		}
+	}
+}
+
+func TestFolderSubtitles(t *testing.T) {
+	item := dlna.Item{ID: "1", Title: "Movie.mkv", Resources: []dlna.Res{
+		{URL: "http://h/1.mkv", ProtocolInfo: "http-get:*:video/x-matroska:*"},
+		{URL: "http://h/1.srt", ProtocolInfo: "http-get:*:text/srt:*"},
+	}}
+	f := Folder{Items: []dlna.Item{
+		item,
+		{ID: "2", Title: "Movie.srt", Resources: []dlna.Res{{URL: "http://h/2.srt", ProtocolInfo: "http-get:*:text/srt:*"}}},
+		{ID: "3", Title: "Movie.hu.vtt", Resources: []dlna.Res{{URL: "http://h/3.vtt", ProtocolInfo: "http-get:*:text/vtt:*"}}},
+		{ID: "4", Title: "Other.en.srt", Resources: []dlna.Res{{URL: "http://h/4.srt", ProtocolInfo: "http-get:*:text/srt:*"}}},
+		{ID: "5", Title: "Movie.hu.srt", Resources: []dlna.Res{{URL: "http://h/1.srt", ProtocolInfo: "http-get:*:text/srt:*"}}},
+	}}
+	var got []string
+	for _, s := range f.Subtitles(item) {
+		got = append(got, s.URL+" "+s.Type+" "+s.Label())
+	}
+	want := []string{"http://h/1.srt srt srt", "http://h/2.srt srt srt", "http://h/3.vtt vtt hu"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+func TestSharedSubtitles(t *testing.T) {
+	srt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1\n00:00:01,000 --> 00:00:02,000\nHi\n"))
+	}))
+	defer srt.Close()
+	h := newHandler(&dlna.Client{})
+	if err := h.configure(defaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.shares.Load(); err != nil {
+		t.Fatal(err)
+	}
+	subRes := []dlna.Res{{URL: srt.URL + "/movie.srt", ProtocolInfo: "http-get:*:text/srt:*"}}
+	data := []Folder{{Container: dlna.Container{ID: "64", Title: "Movies"}, Items: []dlna.Item{
+		{ID: "64$1", ParentID: "64", Title: "Movie.mkv", Class: "object.item.videoItem",
+			Resources: []dlna.Res{{URL: srt.URL + "/movie.mkv", ProtocolInfo: "http-get:*:video/x-matroska:*"}}},
+		{ID: "64$2", ParentID: "64", Title: "Movie.srt", Resources: subRes},
+		{ID: "64$3", ParentID: "64", Title: "Other.mkv", Class: "object.item.videoItem",
+			Resources: []dlna.Res{{URL: srt.URL + "/other.mkv", ProtocolInfo: "http-get:*:video/x-matroska:*"}}},
+		{ID: "64$4", ParentID: "64", Title: "Other.srt", Resources: subRes},
+	}}}
+	lib := library{data: data, fillTime: time.Now(), expires: time.Now().Add(time.Hour)}
+	h.library.Store(&lib)
+	s, err := h.shares.Create(Share{Object: "64$1", Title: "Movie.mkv", Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := h.shares.Query(s)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", sharedURL(s.ID)+"?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("shared page: %d %s", w.Code, w.Body)
+	}
+	trackSrc := subtitleURL("64$1", 0) + "?" + query
+	if !strings.Contains(w.Body.String(), `<track kind="subtitles" src="`+strings.ReplaceAll(trackSrc, "&", "&amp;")+`"`) {
+		t.Errorf("no track for %q in %s", trackSrc, w.Body)
+	}
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{trackSrc, http.StatusOK},
+		{subtitleURL("64$3", 0) + "?" + query, http.StatusForbidden},
+		{subtitleURL("64$1", 0) + "?" + strings.Replace(query, "sig=", "sig=x", 1), http.StatusForbidden},
+		{subtitleURL("64$1", 1) + "?" + query, http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: got %d %s, wanted %d", tc.path, w.Code, w.Body, tc.code)
+		} else if tc.code == http.StatusOK && w.Body.String() != "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000\nHi\n\n" {
+			t.Errorf("%s: got %q", tc.path, w.Body)
+		}
+	}
+
+	// with auth, the share link is the only way in
+	cfg := defaultConfig()
+	cfg.Auth.Tokens = map[string]string{"secret": "admin"}
+	if err := h.configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	h.library.Store(&lib)
+	for path, code := range map[string]int{
+		trackSrc:                      http.StatusOK,
+		subtitleURL("64$1", 0):        http.StatusUnauthorized,
+		sharedURL(s.ID) + "?" + query: http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Errorf("%s with auth: got %d, wanted %d", path, w.Code, code)
+		}
+	}
+}
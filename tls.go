@@ -0,0 +1,255 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig is the configuration of HTTPS; the listeners serve plain HTTP without a certificate.
+type TLSConfig struct {
+	// Cert and Key are the PEM certificate (chain) and key files, reloaded when they change.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	// SelfSigned generates a self-signed certificate (kept in the state directory) if there are no files.
+	SelfSigned bool `json:"selfSigned,omitempty"`
+	// Hosts are the names and IPs of the self-signed certificate, besides the host's own.
+	Hosts []string `json:"hosts,omitempty"`
+	// Redirect are the plain HTTP listen addresses, redirecting to HTTPS;
+	// they serve the DLNA MediaServer, as its clients can't do HTTPS.
+	Redirect []string `json:"redirect,omitempty"`
+	// HSTS is the max-age of the Strict-Transport-Security header, no header is sent if it's zero.
+	HSTS Duration `json:"hsts,omitempty"`
+}
+
+func (c TLSConfig) enabled() bool { return c.Cert != "" || c.Key != "" || c.SelfSigned }
+
+// config returns the TLS configuration of the listeners, nil if HTTPS is not configured.
+func (c TLSConfig) config(state string) (*tls.Config, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.Cert != "" || c.Key != "" {
+		if c.Cert == "" || c.Key == "" {
+			return nil, errors.New("both tls.cert and tls.key are needed")
+		}
+		l := &certLoader{cert: c.Cert, key: c.Key}
+		if err := l.load(); err != nil {
+			return nil, err
+		}
+		tc.GetCertificate = l.GetCertificate
+		return tc, nil
+	}
+	cert, err := selfSignedCert(state, c.Hosts)
+	if err != nil {
+		return nil, fmt.Errorf("self-signed certificate: %w", err)
+	}
+	tc.Certificates = []tls.Certificate{cert}
+	return tc, nil
+}
+
+// certCheckInterval is how often the certificate files are checked for changes.
+const certCheckInterval = 10 * time.Second
+
+// certLoader serves the certificate of the files, reloading it when they change.
+type certLoader struct {
+	cert, key string
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	current *tls.Certificate
+}
+
+func (l *certLoader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{l.cert, l.key} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if mt := fi.ModTime(); mt.After(latest) {
+			latest = mt
+		}
+	}
+	return latest, nil
+}
+
+func (l *certLoader) load() error {
+	modTime, err := l.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(l.cert, l.key)
+	if err != nil {
+		return err
+	}
+	l.current, l.modTime, l.checked = &cert, modTime, time.Now()
+	return nil
+}
+
+// GetCertificate returns the certificate, reloading it if the files changed;
+// the old certificate is kept if the new one can't be loaded (e.g. it's being written).
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.checked) < certCheckInterval {
+		return l.current, nil
+	}
+	l.checked = time.Now()
+	if modTime, err := l.modified(); err != nil {
+		slog.Warn("check certificate", "cert", l.cert, "error", err)
+	} else if !modTime.Equal(l.modTime) {
+		if err := l.load(); err != nil {
+			slog.Warn("reload certificate", "cert", l.cert, "error", err)
+		} else {
+			slog.Info("certificate reloaded", "cert", l.cert)
+		}
+	}
+	return l.current, nil
+}
+
+// selfSignedCert returns the self-signed certificate for the host's names and IPs and hosts,
+// stored in the state directory (if it's not empty), so the browsers' exceptions survive restarts.
+// A new one is generated if there's none, it expires in a month or it doesn't cover all the names.
+func selfSignedCert(state string, hosts []string) (tls.Certificate, error) {
+	hostname, _ := os.Hostname()
+	names, ips := []string{"localhost"}, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if hostname != "" {
+		names = append(names, hostname)
+		if !strings.Contains(hostname, ".") {
+			names = append(names, hostname+".local")
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && !ipn.IP.IsLoopback() && !ipn.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipn.IP)
+			}
+		}
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, h)
+		}
+	}
+
+	var certFile, keyFile string
+	if state != "" {
+		certFile, keyFile = filepath.Join(state, "self-signed.crt"), filepath.Join(state, "self-signed.key")
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && covers(cert.Leaf, names, ips) {
+			return cert, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"webdlna"}, CommonName: names[len(names)-1]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if certFile != "" {
+		if err = os.MkdirAll(state, 0750); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err = os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+		slog.Info("generated self-signed certificate", "file", certFile, "names", names, "ips", ips)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// covers reports whether the certificate is valid for a month more, for all the names and IPs.
+func covers(cert *x509.Certificate, names []string, ips []net.IP) bool {
+	if cert == nil || time.Now().AddDate(0, 1, 0).After(cert.NotAfter) {
+		return false
+	}
+	for _, n := range names {
+		if !slices.Contains(cert.DNSNames, n) {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+			return false
+		}
+	}
+	return true
+}
+
+// redirectHandler redirects to HTTPS on the port, but serves the DLNA MediaServer with its signed media links,
+// and the health checks over plain HTTP, as the renderers may not speak HTTPS.
+// The rest of the media is served only without authentication: the browsers would send their credentials in clear.
+func (h *handler) redirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if strings.HasPrefix(path, "/dlna/") || path == "/healthz" || path == "/readyz" ||
+			(strings.HasPrefix(path, "/media/") && (r.URL.Query().Has("dlna") || h.conf().auth == nil)) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		host := r.Host
+		if hh, _, err := net.SplitHostPort(host); err == nil {
+			host = hh
+		} else {
+			// a bare IPv6 address, e.g. [::1]
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tgulacsi/webdlna/dlna"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	url, _ := fakeContentDirectory(t, "", 0)
+	handlers := make(map[bool]*handler)
+	for _, auth := range []bool{false, true} {
+		h := newHandler(&dlna.Client{})
+		cfg := defaultConfig()
+		cfg.Servers = []string{url}
+		if auth {
+			cfg.Auth.Tokens = map[string]string{"secret": "admin"}
+		}
+		if err := h.configure(cfg); err != nil {
+			t.Fatal(err)
+		}
+		handlers[auth] = h
+	}
+	for _, tc := range []struct {
+		port             int
+		auth             bool
+		host, path, want string
+	}{
+		{443, false, "example.com", "/folders/1?q=x", "https://example.com/folders/1?q=x"},
+		{443, false, "example.com:80", "/", "https://example.com/"},
+		{8443, false, "example.com:8080", "/", "https://example.com:8443/"},
+		{8443, false, "[::1]:8080", "/", "https://[::1]:8443/"},
+		{8443, false, "[::1]", "/", "https://[::1]:8443/"},
+		{443, false, "[::1]", "/", "https://[::1]/"},
+		{443, false, "example.com", "/healthz", ""},
+		{443, false, "example.com", "/dlna/rootDesc.xml", ""},
+		{443, false, "example.com", "/media/1", ""},
+		{443, false, "example.com", "/media/1?share=x", ""},
+		{443, true, "example.com", "/healthz", ""},
+		{443, true, "example.com", "/dlna/rootDesc.xml", ""},
+		{443, true, "example.com", "/media/1?dlna=x", ""},
+		{443, true, "example.com", "/media/1", "https://example.com/media/1"},
+		{443, true, "example.com", "/media/1?share=x&sig=y", "https://example.com/media/1?share=x&sig=y"},
+		{443, true, "example.com", "/folders/1", "https://example.com/folders/1"},
+	} {
+		r := httptest.NewRequest("GET", "http://"+tc.host+tc.path, nil)
+		r.Host = tc.host
+		w := httptest.NewRecorder()
+		handlers[tc.auth].redirectHandler(tc.port).ServeHTTP(w, r)
+		if tc.want == "" {
+			if w.Code == http.StatusPermanentRedirect {
+				t.Errorf("%s%s (auth: %t): redirected to %q", tc.host, tc.path, tc.auth, w.Header().Get("Location"))
+			}
+			continue
+		}
+		if got := w.Header().Get("Location"); w.Code != http.StatusPermanentRedirect || got != tc.want {
+			t.Errorf("%s%s on %d (auth: %t): got %d %q, wanted %q", tc.host, tc.path, tc.port, tc.auth, w.Code, got, tc.want)
+		}
+	}
+}
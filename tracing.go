@@ -0,0 +1,338 @@
+// Copyright 2023 Tamás Gulácsi.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Tracing records OpenTelemetry-style spans, and exports them in the OTLP/JSON encoding,
+// to stdout (one span per line) or to an OTLP/HTTP collector.
+//
+// The trace context is propagated with the W3C traceparent header,
+// from the incoming requests and to the upstream calls.
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// span is a timed operation of a trace. A nil span (tracing disabled) ignores everything.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttr
+	err      error
+}
+
+type spanAttr struct {
+	Key   string
+	Value any
+}
+
+type spanKey struct{}
+
+// tracer is the exporter of the spans, nil if tracing is disabled.
+var tracer *spanExporter
+
+// startSpan starts a span as the child of the context's span, or of the remote parent in the context.
+func startSpan(ctx context.Context, name string, kind int, attrs ...spanAttr) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent, _ := ctx.Value(spanKey{}).(*span); parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetName renames the span.
+func (s *span) SetName(name string) {
+	if s != nil {
+		s.name = name
+	}
+}
+
+// SetAttr sets an attribute of the span.
+func (s *span) SetAttr(key string, value any) {
+	if s != nil {
+		s.attrs = append(s.attrs, spanAttr{key, value})
+	}
+}
+
+// End ends the span, with its error status set from err, and exports it.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+	tracer.export(s)
+}
+
+// traceID returns the trace ID of the context's span, "" if it has none.
+func traceID(ctx context.Context) string {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// traceparent returns the W3C traceparent header value of the context's span, "" if it has none.
+func traceparent(ctx context.Context) string {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// withRemoteParent returns the context with the remote parent span of the W3C traceparent header value,
+// if it's valid, so the spans started with it will be its children.
+func withRemoteParent(ctx context.Context, header string) context.Context {
+	if tracer == nil || len(header) != 55 || header[:3] != "00-" || header[35] != '-' || header[52] != '-' {
+		return ctx
+	}
+	var parent span
+	if _, err := hex.Decode(parent.traceID[:], []byte(header[3:35])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(header[36:52])); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, &parent)
+}
+
+// spanExporter batches the ended spans and writes them to stdout, or posts them to the OTLP endpoint.
+type spanExporter struct {
+	service  string
+	endpoint string
+	w        io.Writer
+	client   *http.Client
+
+	spans chan *span
+	flush chan chan struct{}
+}
+
+const (
+	exportBatch    = 512
+	exportInterval = 5 * time.Second
+)
+
+// startTracing starts exporting the spans to "stdout", or to "otlp" at endpoint;
+// tracing stays disabled if exporter is empty.
+func startTracing(exporter, endpoint, service string) error {
+	e := &spanExporter{
+		service: service, endpoint: endpoint,
+		spans: make(chan *span, 4*exportBatch), flush: make(chan chan struct{}),
+	}
+	switch exporter {
+	case "":
+		return nil
+	case "stdout":
+		e.w = os.Stdout
+	case "otlp":
+		if e.endpoint == "" {
+			e.endpoint = "http://localhost:4318/v1/traces"
+		}
+		e.client = &http.Client{Timeout: 10 * time.Second}
+	default:
+		return fmt.Errorf("unknown trace exporter %q (stdout or otlp)", exporter)
+	}
+	go e.run()
+	tracer = e
+	return nil
+}
+
+// export queues the span, dropping it if the queue is full.
+func (e *spanExporter) export(s *span) {
+	select {
+	case e.spans <- s:
+	default:
+	}
+}
+
+func (e *spanExporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, exportBatch)
+	for {
+		var done chan struct{}
+		select {
+		case s := <-e.spans:
+			if batch = append(batch, s); len(batch) < exportBatch {
+				continue
+			}
+		case <-ticker.C:
+		case done = <-e.flush:
+		drain:
+			for {
+				select {
+				case s := <-e.spans:
+					batch = append(batch, s)
+				default:
+					break drain
+				}
+			}
+		}
+		if len(batch) != 0 {
+			if err := e.write(batch); err != nil {
+				slog.Warn("export spans", "count", len(batch), "error", err)
+			}
+			batch = batch[:0]
+		}
+		if done != nil {
+			close(done)
+		}
+	}
+}
+
+// Flush exports the queued spans, waiting until ctx is done.
+func (e *spanExporter) Flush(ctx context.Context) error {
+	if e == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *spanExporter) write(batch []*span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	if e.w != nil {
+		enc := json.NewEncoder(e.w)
+		for _, s := range spans {
+			if err := enc.Encode(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var req otlpRequest
+	req.ResourceSpans = []otlpResourceSpans{{ScopeSpans: []otlpScopeSpans{{Spans: spans}}}}
+	req.ResourceSpans[0].Resource.Attributes = otlpAttrs([]spanAttr{{"service.name", e.service}})
+	req.ResourceSpans[0].ScopeSpans[0].Scope.Name = "github.com/tgulacsi/webdlna"
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of the spans.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []otlpAttr `json:"attributes,omitempty"`
+		Status            struct {
+			Code    int    `json:"code,omitempty"`
+			Message string `json:"message,omitempty"`
+		} `json:"status"`
+	}
+	otlpAttr struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+)
+
+func (s *span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceID: hex.EncodeToString(s.traceID[:]), SpanID: hex.EncodeToString(s.spanID[:]),
+		Name: s.name, Kind: s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        otlpAttrs(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		o.Status.Code, o.Status.Message = 2, s.err.Error()
+	}
+	return o
+}
+
+func otlpAttrs(attrs []spanAttr) []otlpAttr {
+	list := make([]otlpAttr, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]any
+		switch x := a.Value.(type) {
+		case string:
+			v = map[string]any{"stringValue": x}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(x)}
+		case bool:
+			v = map[string]any{"boolValue": x}
+		case float64:
+			v = map[string]any{"doubleValue": x}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(x)}
+		}
+		list = append(list, otlpAttr{Key: a.Key, Value: v})
+	}
+	return list
+}
@@ -5,312 +5,777 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
-	"encoding/xml"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/a-h/templ"
+	"github.com/tgulacsi/webdlna/dlna"
 )
 
 //go:generate go tool templ generate
 
 func main() {
 	if err := Main(); err != nil {
-		log.Fatal("ERROR:", err)
+		slog.Error("webdlna", "error", err)
+		os.Exit(1)
 	}
 }
 
 func Main() error {
-	flagMiniDLNA := flag.String("minidlna", "http://127.0.0.1:8200", "MiniDLNA server address")
+	flags := newConfigFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [listen address...]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "The listen addresses are [host]:port, unix:/path/to/socket, systemd or systemd:name (socket activation).")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	log.Println("Listening on", flag.Arg(0), "...")
-	return http.ListenAndServe(flag.Arg(0), &handler{baseURL: *flagMiniDLNA, cacheDur: 5 * time.Minute})
+	// load reads the configuration, see loadConfig.
+	load := func() (Config, error) { return loadConfig(flags, os.LookupEnv) }
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	if len(cfg.Listen) == 0 {
+		return errors.New("no listen address is configured")
+	}
+	logHandler, err := newLogHandler(os.Stderr, cfg.Log.Format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(logHandler))
+	tlsConfig, err := cfg.TLS.config(cfg.State)
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	if err = startTracing(cfg.Tracing.Exporter, cfg.Tracing.Endpoint, "webdlna"); err != nil {
+		return err
+	}
+
+	var listeners, redirects []net.Listener
+	closeAll := func() {
+		for _, ln := range slices.Concat(listeners, redirects) {
+			ln.Close()
+		}
+	}
+	for _, addr := range cfg.Listen {
+		lns, err := listen(addr, cfg.Socket)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("listen %q: %w", addr, err)
+		}
+		listeners = append(listeners, lns...)
+	}
+	if tlsConfig != nil {
+		for _, addr := range cfg.TLS.Redirect {
+			lns, err := listen(addr, cfg.Socket)
+			if err != nil {
+				closeAll()
+				return fmt.Errorf("listen %q: %w", addr, err)
+			}
+			redirects = append(redirects, lns...)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	h := newHandler(&dlna.Client{HTTPClient: newHTTPClient(time.Duration(cfg.Upstream.Timeout), cfg.Upstream.Workers)})
+	h.base = ctx
+	if err = h.configure(cfg); err != nil {
+		return err
+	}
+	if cfg.State != "" {
+		h.queues.path = filepath.Join(cfg.State, "queues.json")
+	}
+	if err := h.queues.Load(); err != nil {
+		return err
+	}
+	if cfg.State != "" {
+		h.shares.path = filepath.Join(cfg.State, "shares.json")
+	}
+	if err := h.shares.Load(); err != nil {
+		return err
+	}
+	advertised := make(chan struct{})
+	if !cfg.Features.DLNA {
+		close(advertised)
+	} else {
+		// The DLNA clients can't do HTTPS.
+		addr, lns := cfg.Listen[0], listeners
+		if tlsConfig != nil {
+			addr, lns = cfg.TLS.Redirect[0], redirects
+		}
+		a := firstTCPAddr(lns)
+		if a == nil {
+			closeAll()
+			return errors.New("the DLNA feature needs a TCP listener")
+		}
+		host := a.IP.String()
+		if a.IP.IsUnspecified() {
+			host = ""
+		}
+		hostname, _ := os.Hostname()
+		ms := mediaServer{h: h, name: cfg.Features.DLNAName, uuid: deviceUUID(hostname + addr)}
+		if ms.name == "" {
+			ms.name = "webdlna on " + hostname
+		}
+		ms.register(h.mux)
+		go func() {
+			defer close(advertised)
+			if err := ssdpAdvertise(ctx, ms.uuid, host, a.Port, "/dlna/rootDesc.xml",
+				[]string{dlna.MediaServerType, dlna.ContentDirectoryType, connectionManagerType},
+			); err != nil {
+				slog.Error("ssdp advertise", "error", err)
+			}
+		}()
+	}
+	go func() {
+		if err := h.renderers.Refresh(ctx); err != nil {
+			slog.Warn("search renderers", "error", err)
+		}
+	}()
+	// Crawl in advance, to be ready sooner.
+	go func() {
+		if _, _, err := h.getData(ctx); err != nil {
+			slog.Warn("crawl", "error", err)
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			newCfg, err := load()
+			if err == nil {
+				err = h.configure(newCfg)
+			}
+			if err != nil {
+				slog.Error("reload configuration", "error", err)
+				continue
+			}
+			newTLS, oldTLS := newCfg.TLS, cfg.TLS
+			newTLS.HSTS, oldTLS.HSTS = 0, 0
+			if !slices.Equal(newCfg.Listen, cfg.Listen) || newCfg.Socket != cfg.Socket || newCfg.State != cfg.State ||
+				!slices.Equal(newTLS.Hosts, oldTLS.Hosts) || !slices.Equal(newTLS.Redirect, oldTLS.Redirect) ||
+				newTLS.Cert != oldTLS.Cert || newTLS.Key != oldTLS.Key || newTLS.SelfSigned != oldTLS.SelfSigned ||
+				newCfg.Upstream.Timeout != cfg.Upstream.Timeout || newCfg.Features.DLNA != cfg.Features.DLNA ||
+				newCfg.Log.Format != cfg.Log.Format || newCfg.Tracing != cfg.Tracing {
+				slog.Warn("the listen addresses, the sockets' permissions, the TLS configuration, the state directory, the upstream timeout, the DLNA feature, the log format and the tracing take effect only after a restart")
+			}
+			slog.Info("configuration reloaded")
+		}
+	}()
+
+	servers := make([]*http.Server, 0, len(listeners)+len(redirects))
+	errc := make(chan error, cap(servers))
+	for _, ln := range listeners {
+		srv := &http.Server{Addr: ln.Addr().String(), Handler: h, TLSConfig: tlsConfig}
+		servers = append(servers, srv)
+		slog.Info("listening", "network", ln.Addr().Network(), "addr", srv.Addr, "tls", tlsConfig != nil)
+		if tlsConfig != nil {
+			go func() { errc <- srv.ServeTLS(ln, "", "") }()
+		} else {
+			go func() { errc <- srv.Serve(ln) }()
+		}
+	}
+	httpsPort := 443
+	if a := firstTCPAddr(listeners); a != nil {
+		httpsPort = a.Port
+	}
+	for _, ln := range redirects {
+		srv := &http.Server{Addr: ln.Addr().String(), Handler: h.redirectHandler(httpsPort)}
+		servers = append(servers, srv)
+		slog.Info("redirecting to HTTPS", "network", ln.Addr().Network(), "addr", srv.Addr)
+		go func() { errc <- srv.Serve(ln) }()
+	}
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	}
+	// A second signal kills the process.
+	stop()
+	err = errors.Join(err, h.shutdown(servers))
+	select {
+	case <-advertised:
+	case <-time.After(time.Second):
+		slog.Warn("ssdp byebye timed out")
+	}
+	return err
+}
+
+// shutdown stops the servers, waiting at most shutdownTimeout for the in-flight requests,
+// then stops the queue players, saves the state and exports the remaining spans.
+func (h *handler) shutdown(servers []*http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.conf().shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("shutdown %s: %w", srv.Addr, err)
+				srv.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(append(errs, h.queues.Close(), tracer.Flush(ctx))...)
 }
 
 type handler struct {
-	baseURL  string
-	cacheDur time.Duration
+	mux      *http.ServeMux
+	settings atomic.Pointer[settings]
+	// client is used for all the calls to the upstream servers and the renderers.
+	client *dlna.Client
+	// base is canceled on shutdown, stopping the running crawl.
+	base context.Context
 
-	mu       sync.Mutex
-	fillTime time.Time
+	crawler   crawler
+	renderers renderers
+	queues    queues
+	shares    shares
+
+	// mu serializes the crawls; the crawled library is published in library,
+	// so the readers don't wait for a running crawl.
+	mu      sync.Mutex
+	library atomic.Pointer[library]
+
+	snapshots snapshots
+}
+
+// library is a crawled snapshot of the upstream servers.
+type library struct {
 	data     []Folder
-	// etag     string
+	fillTime time.Time
+	expires  time.Time
+	// err is the error of the last crawl, if it failed.
+	err error
 }
 
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "" && r.URL.Path != "/" {
-		http.Error(w, r.URL.Path+" Not Found", http.StatusNotFound)
-		return
+// lib returns the last crawled library, the zero one before the first crawl.
+func (h *handler) lib() library {
+	if l := h.library.Load(); l != nil {
+		return *l
 	}
+	return library{}
+}
 
-	ctx := r.Context()
-	now := time.Now()
+// newHandler returns the handler, calling the upstream servers and the renderers with the client.
+func newHandler(client *dlna.Client) *handler {
+	h := handler{mux: http.NewServeMux(), base: context.Background(), client: client}
+	h.crawler.client, h.renderers.client = client, client
+	h.mux.HandleFunc("GET /{$}", h.serveIndex)
+	h.mux.HandleFunc("GET /metrics", h.serveMetrics)
+	h.mux.HandleFunc("GET /healthz", h.serveHealthz)
+	h.mux.HandleFunc("GET /readyz", h.serveReadyz)
+	h.mux.HandleFunc("GET /status", h.serveStatus)
+	h.mux.HandleFunc("GET /folders/{id}", h.serveFolder)
+	h.mux.HandleFunc("GET /api/folders", h.serveAPIFolders)
+	h.mux.HandleFunc("GET /api/folders/{id}", h.serveAPIFolder)
+	h.mux.HandleFunc("GET /play/{id}", h.servePlay)
+	h.mux.HandleFunc("GET /items/{id}", h.serveItem)
+	h.mux.HandleFunc("GET /subtitles/{id}/{n}", h.serveSubtitle)
+	h.mux.HandleFunc("GET /media/{id}", h.serveMedia)
+	h.mux.HandleFunc("GET /renderers", h.serveRenderers)
+	h.mux.HandleFunc("GET /renderers/{renderer}", h.serveRemote)
+	h.mux.HandleFunc("POST /renderers/{renderer}/{action}", h.serveRendererAction)
+	h.mux.HandleFunc("GET /api/renderers/{renderer}/volume", h.serveVolume)
+	h.mux.HandleFunc("PUT /api/renderers/{renderer}/volume", h.serveVolume)
+	h.mux.HandleFunc("GET /queues", h.serveQueues)
+	h.mux.HandleFunc("POST /queues", h.serveQueueAdd)
+	h.mux.HandleFunc("GET /queues/{name}", h.serveQueue)
+	h.mux.HandleFunc("POST /queues/{name}/{action}", h.serveQueueAction)
+	h.queues.lookup = h.lookupItem
+	h.mux.HandleFunc("GET /shares", h.serveShares)
+	h.mux.HandleFunc("POST /shares", h.serveShareCreate)
+	h.mux.HandleFunc("POST /shares/{id}/revoke", h.serveShareRevoke)
+	h.mux.HandleFunc("GET /shared/{id}", h.serveShared)
+	return &h
+}
+
+// configure swaps the handler's settings for the configuration's,
+// and drops the cached data, as the servers or the rules may have changed.
+func (h *handler) configure(cfg Config) error {
+	s, err := cfg.settings()
+	if err != nil {
+		return err
+	}
+	h.settings.Store(s)
+	h.crawler.Configure(s.crawl)
+	logLevel.Set(s.logLevel)
+	h.renderers.Configure(cfg.Renderers, s.discover)
 	h.mu.Lock()
-	defer h.mu.Unlock()
-	if h.fillTime.Add(h.cacheDur).After(now) {
-		log.Printf("serving from cache of %s", h.fillTime)
+	l := h.lib()
+	l.expires = time.Time{}
+	h.library.Store(&l)
+	h.mu.Unlock()
+	return nil
+}
+
+// conf returns the current settings.
+func (h *handler) conf() *settings { return h.settings.Load() }
+
+// ServeHTTP serves the request with a request ID in a span, logging it and recording its metrics.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	id := newRequestID(r.Header.Get("X-Request-ID"))
+	w.Header().Set("X-Request-ID", id)
+	s := h.conf()
+	if r.TLS != nil && s.hsts > 0 {
+		w.Header().Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(s.hsts.Seconds())))
+	}
+	base := s.requestBase(r)
+	r = stripPrefix(r, base.Prefix)
+	ctx := withBase(withRequestID(withRemoteParent(r.Context(), r.Header.Get("traceparent")), id), base)
+	ctx, sp := startSpan(ctx, r.Method, spanKindServer,
+		spanAttr{"http.request.method", r.Method}, spanAttr{"url.path", r.URL.Path})
+	r = r.WithContext(ctx)
+	sw := &statusWriter{ResponseWriter: w}
+	// The media is not compressed: it's compressed already, and the ranges must stay intact.
+	if enc := negotiateEncoding(r.Header.Get("Accept-Encoding")); enc != "" &&
+		!strings.HasPrefix(r.URL.Path, "/media/") && r.Header.Get("Range") == "" {
+		cw := &compressWriter{ResponseWriter: sw, encoding: enc}
+		h.serve(cw, r)
+		if err := cw.Close(); err != nil {
+			slog.WarnContext(ctx, "compress", "error", err)
+		}
 	} else {
-		data, err := getFolders(ctx, h.baseURL)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadGateway)
+		h.serve(sw, r)
+	}
+	route := r.Pattern
+	if route == "" {
+		route = "unmatched"
+	}
+	code, dur := cmp.Or(sw.code, http.StatusOK), time.Since(start)
+	sp.SetName(route)
+	sp.SetAttr("http.route", route)
+	sp.SetAttr("http.response.status_code", code)
+	var err error
+	if code >= 500 {
+		err = errors.New(http.StatusText(code))
+	}
+	sp.End(err)
+	metrics.httpRequests.Add(1, route, strconv.Itoa(code))
+	metrics.httpDuration.Observe(dur.Seconds(), route)
+	slog.InfoContext(ctx, "http", "method", r.Method, "path", r.URL.Path, "route", route,
+		"status", code, "bytes", sw.written, "duration", dur)
+}
+
+// serve requires authentication (if configured) for everything but the DLNA MediaServer's description and SOAP,
+// whose clients can't authenticate, the health checks and the signed share and DLNA media links (checked by their handlers).
+func (h *handler) serve(w http.ResponseWriter, r *http.Request) {
+	if auth := h.conf().auth; auth != nil && !public(r) {
+		user, ok := auth.Authenticate(r)
+		if !ok {
+			auth.Challenge(w)
 			return
 		}
-		h.data, h.fillTime = data, now
-		log.Printf("fresh data retrieved in %s", time.Since(now))
+		ur := r.WithContext(withUser(r.Context(), user))
+		h.mux.ServeHTTP(w, ur)
+		r.Pattern = ur.Pattern // for the route label of ServeHTTP
+		return
 	}
+	h.mux.ServeHTTP(w, r)
+}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(h.cacheDur.Seconds())))
-	w.Header().Set("Age", strconv.Itoa(int(now.Sub(h.fillTime).Seconds())))
-
-	printPage(h.baseURL, printFolders(h.data)).Render(ctx, w)
+func public(r *http.Request) bool {
+	path := r.URL.Path
+	return strings.HasPrefix(path, "/dlna/") || path == "/healthz" || path == "/readyz" ||
+		strings.HasPrefix(path, "/shared/") ||
+		(strings.HasPrefix(path, "/media/") && (r.URL.Query().Has("share") || r.URL.Query().Has("dlna"))) ||
+		(strings.HasPrefix(path, "/subtitles/") && r.URL.Query().Has("share"))
 }
 
-func getFolders(ctx context.Context, baseURL string) ([]Folder, error) {
-	root, err := getRootDesc(ctx, baseURL)
+// serveIndex lists all the folders, filtered and sorted (locally) by the query parameters.
+func (h *handler) serveIndex(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lq, err := parseListQuery(r)
 	if err != nil {
-		return nil, err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, fillTime, err := h.getData(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if len(lq.keys) != 0 || lq.Q != "" {
+		filtered := make([]Folder, 0, len(data))
+		for _, f := range data {
+			if f.Items = filterItems(h.conf().rules.Items(sortItems(f.Items, lq.keys)), lq.Q); len(f.Items) != 0 || f.Err != nil {
+				filtered = append(filtered, f)
+			}
+		}
+		data = filtered
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	s := h.conf()
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(s.cacheDur.Seconds())))
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(fillTime).Seconds())))
+
+	page := printPage(strings.Join(s.servers, ", "), printFolders(data, lq))
+	if len(lq.keys) != 0 || lq.Q != "" {
+		renderPage(ctx, w, page)
+		return
 	}
 
-	cpath := root.ContentPath()
-	dl, err := root.post(ctx, cpath, getObjectID("0"))
+	// The full library page is served from the precompressed renders of the snapshot.
+	sum := sha256.Sum256([]byte(strconv.FormatInt(fillTime.UnixNano(), 10) + "\x00" + userOf(ctx) + "\x00" + link(ctx, "")))
+	key := hex.EncodeToString(sum[:8])
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	etag := encodedETag(key, encoding)
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	b, err := h.snapshots.Get(fillTime, key, encoding, func() ([]byte, error) {
+		var buf bytes.Buffer
+		err := renderPage(ctx, &buf, page)
+		return buf.Bytes(), err
+	})
 	if err != nil {
-		return nil, err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
 	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
 
-	// on 8 threads it's 4.7s, with no concurrency it's 2.8s
-	var data []Folder
-	for _, container := range dl.Containers {
-		if err := ctx.Err(); err != nil {
-			return data, err
-		}
-		fl, err := root.post(ctx, cpath, getObjectID(container.ID))
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		for _, folder := range fl.Containers {
-			if strings.HasPrefix(folder.Title, "All ") {
-				continue
-			}
-			ff, err := root.post(ctx, cpath, getObjectID(folder.ID))
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			if len(ff.Items) == 0 {
-				continue
-			}
-			data = append(data, Folder{Container: folder, Items: ff.Items})
+// folder returns the folder with the given ID, and its items filtered and sorted by the query parameters.
+func (h *handler) folder(r *http.Request) (Folder, listQuery, error) {
+	ctx := r.Context()
+	lq, err := parseListQuery(r)
+	if err != nil {
+		return Folder{}, lq, err
+	}
+	data, fillTime, err := h.getData(ctx)
+	if err != nil {
+		return Folder{}, lq, err
+	}
+	id := r.PathValue("id")
+	for _, f := range data {
+		if f.ID == id {
+			f.Items = filterItems(h.sortedItems(ctx, f, lq.keys, fillTime), lq.Q)
+			return f, lq, nil
 		}
 	}
-	return data, nil
+	return Folder{}, lq, fmt.Errorf("folder %q: %w", id, errNoSuchObject)
 }
 
-const (
-	contentType = "text/xml; charset=utf-8"
-	soapAction  = "urn:schemas-upnp-org:service:ContentDirectory:1#Browse"
-)
+func (h *handler) serveFolder(w http.ResponseWriter, r *http.Request) {
+	f, lq, err := h.folder(r)
+	if err != nil {
+		http.Error(w, err.Error(), folderErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(r.Context(), w, printPage(f.Title, printFolderPage(f, lq)))
+}
+
+// jsonFolder is a folder in the JSON API.
+type jsonFolder struct {
+	ID        string      `json:"id"`
+	Title     string      `json:"title"`
+	ItemCount int         `json:"itemCount"`
+	Items     []dlna.Item `json:"items,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
 
-func getObjectID(index string) string {
-	var buf strings.Builder
-	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>
-        <s:Envelope xmlns:ns0="urn:schemas-upnp-org:service:ContentDirectory:1" xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
-          <s:Body>
-            <ns0:Browse>
-              <ObjectID>`)
-	xml.EscapeText(&buf, []byte(index))
-	buf.WriteString(`</ObjectID>
-              <BrowseFlag>BrowseDirectChildren</BrowseFlag>
-              <Filter>*</Filter>
-            </ns0:Browse>
-          </s:Body>
-        </s:Envelope>
-      </xml>`)
-	return buf.String()
-}
-
-// Root was generated 2023-05-13 18:18:47 by https://xml-to-go.github.io/ in Ukraine.
-type Root struct {
-	XMLName     xml.Name `xml:"root" json:"root,omitempty"`
-	baseURL     string   `xml:"-"`
-	Text        string   `xml:",chardata" json:"text,omitempty"`
-	Xmlns       string   `xml:"xmlns,attr" json:"xmlns,omitempty"`
-	SpecVersion struct {
-		Text  string `xml:",chardata" json:"text,omitempty"`
-		Major string `xml:"major"`
-		Minor string `xml:"minor"`
-	} `xml:"specVersion" json:"specversion,omitempty"`
-	Device struct {
-		Text             string `xml:",chardata" json:"text,omitempty"`
-		DeviceType       string `xml:"deviceType"`
-		FriendlyName     string `xml:"friendlyName"`
-		Manufacturer     string `xml:"manufacturer"`
-		ManufacturerURL  string `xml:"manufacturerURL"`
-		ModelDescription string `xml:"modelDescription"`
-		ModelName        string `xml:"modelName"`
-		ModelNumber      string `xml:"modelNumber"`
-		ModelURL         string `xml:"modelURL"`
-		SerialNumber     string `xml:"serialNumber"`
-		UDN              string `xml:"UDN"`
-		XDLNADOC         struct {
-			Text string `xml:",chardata" json:"text,omitempty"`
-			Dlna string `xml:"dlna,attr" json:"dlna,omitempty"`
-		} `xml:"X_DLNADOC" json:"x_dlnadoc,omitempty"`
-		PresentationURL string `xml:"presentationURL"`
-		IconList        struct {
-			Text string `xml:",chardata" json:"text,omitempty"`
-			Icon []struct {
-				Text     string `xml:",chardata" json:"text,omitempty"`
-				Mimetype string `xml:"mimetype"`
-				Width    string `xml:"width"`
-				Height   string `xml:"height"`
-				Depth    string `xml:"depth"`
-				URL      string `xml:"url"`
-			} `xml:"icon" json:"icon,omitempty"`
-		} `xml:"iconList" json:"iconlist,omitempty"`
-		ServiceList struct {
-			Text    string `xml:",chardata" json:"text,omitempty"`
-			Service []struct {
-				Text        string `xml:",chardata" json:"text,omitempty"`
-				ServiceType string `xml:"serviceType"`
-				ServiceId   string `xml:"serviceId"`
-				ControlURL  string `xml:"controlURL"`
-				EventSubURL string `xml:"eventSubURL"`
-				SCPDURL     string `xml:"SCPDURL"`
-			} `xml:"service" json:"service,omitempty"`
-		} `xml:"serviceList" json:"servicelist,omitempty"`
-	} `xml:"device" json:"device,omitempty"`
-}
-
-func getRootDesc(ctx context.Context, baseURL string) (Root, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/rootDesc.xml", nil)
+func newJSONFolder(f Folder) jsonFolder {
+	jf := jsonFolder{ID: f.ID, Title: f.Title}
+	if f.Err != nil {
+		jf.Error = f.Err.Error()
+	}
+	jf.Items, jf.ItemCount = f.Items, len(f.Items)
+	return jf
+}
+
+// serveAPIFolders lists the folders, without their items.
+func (h *handler) serveAPIFolders(w http.ResponseWriter, r *http.Request) {
+	data, _, err := h.getData(r.Context())
 	if err != nil {
-		return Root{}, err
+		writeJSONError(w, err, errorStatus(err))
+		return
 	}
-	resp, err := http.DefaultClient.Do(req)
+	folders := make([]jsonFolder, len(data))
+	for i, f := range data {
+		folders[i] = newJSONFolder(f)
+		folders[i].Items = nil
+	}
+	writeJSON(w, folders)
+}
+
+// serveAPIFolder returns the folder with its items, filtered and sorted by the "q" and "sort" query parameters.
+func (h *handler) serveAPIFolder(w http.ResponseWriter, r *http.Request) {
+	f, _, err := h.folder(r)
 	if err != nil {
-		return Root{}, err
+		writeJSONError(w, err, folderErrorStatus(err))
+		return
+	}
+	writeJSON(w, newJSONFolder(f))
+}
+
+func folderErrorStatus(err error) int {
+	if errors.Is(err, errBadSort) {
+		return http.StatusBadRequest
 	}
-	defer resp.Body.Close()
-	b, err := io.ReadAll(resp.Body)
+	return errorStatus(err)
+}
+
+func (h *handler) servePlay(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	folder, item, err := h.lookup(ctx, r.PathValue("id"))
 	if err != nil {
-		return Root{}, err
+		http.Error(w, err.Error(), errorStatus(err))
+		return
 	}
-	var root Root
-	if err = xml.Unmarshal(b, &root); err != nil {
-		return Root{}, fmt.Errorf("parse %q: %w", string(b), err)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(ctx, w, printPage(item.Title, printPlayer(item, folder.Subtitles(item), h.renderers.List(), h.queues.List(h.owner(r)))))
+}
+
+// serveItem shows the metadata of the item, fetched fresh from the upstream server.
+func (h *handler) serveItem(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	item, err := h.fetchItem(ctx, r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
 	}
-	root.baseURL = baseURL
-	return root, err
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	renderPage(ctx, w, printPage(item.Title, printItem(item)))
 }
 
-func (r Root) ContentPath() string {
-	// services = list(map(lambda service: parse_service(service), root.getElementsByTagName('service')))
-	// content = [ service for service in services if service['name'] == 'urn:schemas-upnp-org:service:ContentDirectory:1' ][0]
-	for _, svc := range r.Device.ServiceList.Service {
-		if svc.ServiceType == "urn:schemas-upnp-org:service:ContentDirectory:1" {
-			return svc.ControlURL
+// getData returns the cached folders the context's user may see,
+// refreshing them if they're older than cacheDur, or errorCacheDur if some folders failed.
+func (h *handler) getData(ctx context.Context) ([]Folder, time.Time, error) {
+	data, fillTime, err := h.cachedData(ctx)
+	return h.conf().auth.Visible(userOf(ctx), data), fillTime, err
+}
+
+// cachedData returns all the cached folders, refreshing them if needed, see getData.
+func (h *handler) cachedData(ctx context.Context) ([]Folder, time.Time, error) {
+	now := time.Now()
+	if l := h.lib(); now.Before(l.expires) {
+		slog.DebugContext(ctx, "serving from cache", "fillTime", l.fillTime)
+		metrics.cacheHits.Add(1)
+		return l.data, l.fillTime, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// another crawl may have finished while waiting
+	l := h.lib()
+	if now.Before(l.expires) {
+		metrics.cacheHits.Add(1)
+		return l.data, l.fillTime, nil
+	}
+	metrics.cacheMisses.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(h.base, cancel)
+	defer stop()
+	s := h.conf()
+	data, err := h.crawler.Crawl(ctx, s.servers)
+	if err != nil {
+		l.err = err
+		h.library.Store(&l)
+		return nil, l.fillTime, err
+	}
+	l = library{data: s.rules.Apply(data), fillTime: now, expires: now.Add(s.cacheDur)}
+	for _, f := range l.data {
+		if f.Err != nil {
+			l.expires = now.Add(s.errorCacheDur)
+			break
 		}
 	}
-	return ""
+	h.library.Store(&l)
+	slog.InfoContext(ctx, "fresh data retrieved", "duration", time.Since(now))
+	return l.data, l.fillTime, nil
 }
 
-func (r Root) post(ctx context.Context, path, data string) (dl DIDLLite, err error) {
-	req, err := http.NewRequestWithContext(ctx, "POST", r.baseURL+path, strings.NewReader(data))
+// renderPage renders the page, in a span.
+func renderPage(ctx context.Context, w io.Writer, page templ.Component) error {
+	ctx, sp := startSpan(ctx, "render", spanKindInternal)
+	err := page.Render(ctx, w)
+	sp.End(err)
 	if err != nil {
-		return dl, err
+		slog.WarnContext(ctx, "render", "error", err)
 	}
-	req.Header.Set("Content-Type", contentType)
-	req.Header.Set("SOAPAction", soapAction)
-	resp, err := http.DefaultClient.Do(req)
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("encode JSON", "type", fmt.Sprintf("%T", v), "error", err)
+	}
+}
+
+// writeJSONError writes the error as JSON, with the UPnP error code and description, if err is a UPnPError.
+func writeJSONError(w http.ResponseWriter, err error, code int) {
+	resp := struct {
+		Error       string `json:"error"`
+		UPnPCode    int    `json:"upnpErrorCode,omitempty"`
+		Description string `json:"upnpErrorDescription,omitempty"`
+	}{Error: err.Error()}
+	var ue *dlna.UPnPError
+	if errors.As(err, &ue) {
+		resp.UPnPCode, resp.Description = ue.Code, ue.Description
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// lookupItem returns the item with the given ID, see lookup.
+func (h *handler) lookupItem(ctx context.Context, id string) (dlna.Item, error) {
+	_, item, err := h.lookup(ctx, id)
+	return item, err
+}
+
+// lookup returns the item with the given ID and its folder from the cached data,
+// or fetches it from its upstream server if it's not cached (yet).
+//
+// The folder of a fetched item holds only the item itself.
+func (h *handler) lookup(ctx context.Context, id string) (Folder, dlna.Item, error) {
+	data, _, err := h.getData(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "lookup", "objectID", id, "error", err)
+	} else if folder, item, ok := findItem(data, id); ok {
+		return folder, item, nil
+	}
+	item, err := h.fetchItem(ctx, id)
 	if err != nil {
-		return dl, err
-	}
-	defer resp.Body.Close()
-	var envelope Envelope
-	if err = xml.NewDecoder(resp.Body).Decode(&envelope); err != nil {
-		return dl, err
-	}
-	if err = xml.Unmarshal([]byte(envelope.Body.BrowseResponse.Result), &dl); err != nil {
-		return dl, fmt.Errorf("unmarshal %q: %w", envelope.Body.BrowseResponse.Result, err)
-	}
-	return dl, nil
-}
-
-// Envelope was generated 2023-05-13 18:40:05 by https://xml-to-go.github.io/ in Ukraine.
-type Envelope struct {
-	XMLName       xml.Name `xml:"Envelope" json:"envelope,omitempty"`
-	Text          string   `xml:",chardata" json:"text,omitempty"`
-	S             string   `xml:"s,attr" json:"s,omitempty"`
-	EncodingStyle string   `xml:"encodingStyle,attr" json:"encodingstyle,omitempty"`
-	Body          struct {
-		Text           string `xml:",chardata" json:"text,omitempty"`
-		BrowseResponse struct {
-			Text           string `xml:",chardata" json:"text,omitempty"`
-			U              string `xml:"u,attr" json:"u,omitempty"`
-			Result         string `xml:"Result"`
-			NumberReturned string `xml:"NumberReturned"`
-			TotalMatches   string `xml:"TotalMatches"`
-			UpdateID       string `xml:"UpdateID"`
-		} `xml:"BrowseResponse" json:"browseresponse,omitempty"`
-	} `xml:"Body" json:"body,omitempty"`
-}
-
-// DIDLLite was generated 2023-05-13 18:56:01 by https://xml-to-go.github.io/ in Ukraine.
-type DIDLLite struct {
-	XMLName    xml.Name    `xml:"DIDL-Lite" json:"didl-lite,omitempty"`
-	Text       string      `xml:",chardata" json:"text,omitempty"`
-	Dc         string      `xml:"dc,attr" json:"dc,omitempty"`
-	Upnp       string      `xml:"upnp,attr" json:"upnp,omitempty"`
-	Xmlns      string      `xml:"xmlns,attr" json:"xmlns,omitempty"`
-	Dlna       string      `xml:"dlna,attr" json:"dlna,omitempty"`
-	Containers []Container `xml:"container" json:"container,omitempty"`
-	Items      []Item      `xml:"item" json:"item,omitempty"`
-}
-type Container struct {
-	Text        string `xml:",chardata" json:"text,omitempty"`
-	ID          string `xml:"id,attr" json:"id,omitempty"`
-	ParentID    string `xml:"parentID,attr" json:"parentid,omitempty"`
-	Restricted  string `xml:"restricted,attr" json:"restricted,omitempty"`
-	Searchable  string `xml:"searchable,attr" json:"searchable,omitempty"`
-	ChildCount  string `xml:"childCount,attr" json:"childcount,omitempty"`
-	Title       string `xml:"title"`
-	Class       string `xml:"class"`
-	StorageUsed string `xml:"storageUsed"`
-}
-type Item struct {
-	Text       string `xml:",chardata" json:"text,omitempty"`
-	ID         string `xml:"id,attr" json:"id,omitempty"`
-	ParentID   string `xml:"parentID,attr" json:"parentid,omitempty"`
-	Restricted string `xml:"restricted,attr" json:"restricted,omitempty"`
-	Title      string `xml:"title"`
-	Class      string `xml:"class"`
-	Creator    string `xml:"creator"`
-	Date       string `xml:"date"`
-	Res        Res    `xml:"res" json:"res,omitempty"`
-}
-type Res struct {
-	URL             string `xml:",chardata" json:"url,omitempty"`
-	Size            string `xml:"size,attr" json:"size,omitempty"`
-	Duration        string `xml:"duration,attr" json:"duration,omitempty"`
-	Bitrate         string `xml:"bitrate,attr" json:"bitrate,omitempty"`
-	SampleFrequency string `xml:"sampleFrequency,attr" json:"samplefrequency,omitempty"`
-	NrAudioChannels string `xml:"nrAudioChannels,attr" json:"nraudiochannels,omitempty"`
-	Resolution      string `xml:"resolution,attr" json:"resolution,omitempty"`
-	ProtocolInfo    string `xml:"protocolInfo,attr" json:"protocolinfo,omitempty"`
+		return Folder{}, item, err
+	}
+	return Folder{Container: dlna.Container{ID: item.ParentID}, Items: []dlna.Item{item}}, item, nil
+}
+
+// fetchItem fetches the item with BrowseMetadata from its upstream server.
+func (h *handler) fetchItem(ctx context.Context, id string) (dlna.Item, error) {
+	s := h.conf()
+	n, objectID, ok := s.splitID(id)
+	if !ok {
+		return dlna.Item{}, fmt.Errorf("%q: %w", id, errNoSuchObject)
+	}
+	dl, err := h.crawler.Metadata(ctx, s.servers[n], objectID)
+	if err != nil {
+		return dlna.Item{}, err
+	}
+	if len(dl.Items) == 0 {
+		return dlna.Item{}, fmt.Errorf("%q is not an item: %w", id, errNoSuchObject)
+	}
+	f := Folder{Items: dl.Items[:1]}
+	if len(s.servers) > 1 {
+		f = f.qualify(n)
+	}
+	item := f.Items[0]
+	if s.rules.HideItem(item) {
+		return dlna.Item{}, fmt.Errorf("%q is hidden: %w", id, errNoSuchObject)
+	}
+	// A restricted user may see only the items of the allowed folders.
+	if s.auth.Restricted(userOf(ctx)) {
+		data, _, err := h.getData(ctx)
+		if err != nil {
+			return dlna.Item{}, err
+		}
+		if !slices.ContainsFunc(data, func(f Folder) bool { return f.ID == item.ParentID }) {
+			return dlna.Item{}, fmt.Errorf("%q is not allowed: %w", id, errNoSuchObject)
+		}
+	}
+	return item, nil
+}
+
+// splitID returns the index of the upstream server and the server's own object ID of the id.
+func (s *settings) splitID(id string) (int, string, bool) {
+	if len(s.servers) == 1 {
+		return 0, id, true
+	}
+	prefix, objectID, ok := strings.Cut(id, ":")
+	if !ok {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(prefix)
+	if err != nil || n < 0 || n >= len(s.servers) {
+		return 0, "", false
+	}
+	return n, objectID, true
+}
+
+func playURL(id string) string   { return "/play/" + url.PathEscape(id) }
+func itemURL(id string) string   { return "/items/" + url.PathEscape(id) }
+func folderURL(id string) string { return "/folders/" + url.PathEscape(id) }
+
+func findItem(folders []Folder, id string) (Folder, dlna.Item, bool) {
+	for _, f := range folders {
+		for _, i := range f.Items {
+			if i.ID == id {
+				return f, i, true
+			}
+		}
+	}
+	return Folder{}, dlna.Item{}, false
+}
+
+func newHTTPClient(timeout time.Duration, workers int) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.MaxIdleConnsPerHost = max(workers, 2)
+	return &http.Client{Transport: metricsTransport{tr}, Timeout: timeout}
+}
+
+func getRootDesc(ctx context.Context, client *dlna.Client, baseURL string) (dlna.Root, error) {
+	return client.Describe(ctx, baseURL+"/rootDesc.xml")
 }
 
 type Folder struct {
-	Container
-	Items []Item
+	dlna.Container
+	Items []dlna.Item
+	// Err is the error of retrieving the folder's items.
+	Err error
+}
+
+// qualify prefixes the IDs in the folder with the server's index.
+func (f Folder) qualify(server int) Folder {
+	prefix := strconv.Itoa(server) + ":"
+	f.ID, f.ParentID = prefix+f.ID, prefix+f.ParentID
+	items := make([]dlna.Item, len(f.Items))
+	for i, it := range f.Items {
+		it.ID, it.ParentID = prefix+it.ID, prefix+it.ParentID
+		items[i] = it
+	}
+	f.Items = items
+	return f
 }
 
 func stripSize(s string) string {